@@ -3,18 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 
 	"github.com/mitchellh/mapstructure"
 )
 
-// Global variables for Json RPC request IDs
+// Printer status codes
 const (
-	IdDefaultDisplay      = 1000
-	IdDisplayNotification = 2223
-	IdPrintStatus         = 7777
-	IdStartFileNamePrint  = 5555
-
 	Standby   = 0
 	Printing  = 1
 	Completed = 2
@@ -22,21 +16,24 @@ const (
 	Canceled  = 4
 	Setup     = 5
 	Resetting = 6
-	E         = 9
+	// Held out of the pool after a failed print until acknowledged
+	Maintenance = 7
+	E           = 9
 )
 
 type Jsonrpc struct {
-	Jsonrpc string       `json:"jsonrpc,omitempty"`
-	Method  string       `json:"method,omitempty"`
-	Id      int          `json:"id,omitempty"`
-	Params  interface{}  `json:"params,omitempty"`
-	Result  interface{}  `json:"result,omitempty"`
-	Error   Error_object `json:"error,omitempty"`
+	Jsonrpc string        `json:"jsonrpc,omitempty"`
+	Method  string        `json:"method,omitempty"`
+	Id      int           `json:"id,omitempty"`
+	Params  interface{}   `json:"params,omitempty"`
+	Result  interface{}   `json:"result,omitempty"`
+	Error   *Error_object `json:"error,omitempty"`
 }
 
 type Params_object struct {
 	Script   string      `json:"script,omitempty"`
 	Filename string      `json:"filename,omitempty"`
+	Root     string      `json:"root,omitempty"`
 	Objects  interface{} `json:"objects,omitempty"`
 }
 
@@ -46,6 +43,11 @@ type Error_object struct {
 	Data    string `json:"data,omitempty"`
 }
 
+// Error lets a JSON RPC error reply be returned as a Go error
+func (e *Error_object) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
 type Result_object struct {
 	State            string         `json:"state,omitempty"`
 	State_message    string         `json:"state_message,omitempty"`
@@ -57,6 +59,9 @@ type Result_object struct {
 	Config_file      string         `json:"config_file,omitempty"`
 	Status           Objects_object `json:"status,omitempty"`
 	Eventtime        float32        `json:"eventtime,omitempty"`
+
+	// Undecoded result, for objects Objects_object doesn't model
+	Raw map[string]interface{} `json:"-" mapstructure:"-"`
 }
 
 type Objects_object struct {
@@ -78,6 +83,17 @@ type Webhooks_object struct {
 	State_message string `json:"state_message,omitempty"`
 }
 
+type Heater_object struct {
+	Temperature float64 `json:"temperature,omitempty"`
+	Target      float64 `json:"target,omitempty"`
+	Power       float64 `json:"power,omitempty"`
+}
+
+type Display_status_object struct {
+	Progress float64 `json:"progress,omitempty"`
+	Message  string  `json:"message,omitempty"`
+}
+
 type Print_stats_object struct {
 	Print_duration float32 `json:"print_duration,omitempty"`
 	Total_duration float32 `json:"total_duration,omitempty"`
@@ -108,60 +124,15 @@ func JsonUnmarshal(bytes []byte) (*Jsonrpc, error) {
 		ro := new(Result_object)
 		mapstructure.Decode(v, &ro)
 		// Create fields for Status under Results_object
-		if raw.Id == IdPrintStatus {
+		if _, ok := v["status"]; ok {
 			ro.Create_status_object()
 		}
+		ro.Raw = v
 		raw.Result = *ro
 	}
 	return raw, err
 }
 
-/*
-Debug function to print contents of JSON RPC to console
-*/
-func (p *Jsonrpc) Print_jsonrpc_data() {
-	log.Print(">> recv\n")
-
-	if p.Method != "" {
-		fmt.Printf("Method: %s\n", p.Method)
-	}
-
-	if p.Params != nil {
-		switch v := p.Params.(type) {
-		case []string:
-			fmt.Printf("Params: %s\n", v)
-		case interface{}:
-			fmt.Printf("Params:")
-			indented_v, err := json.MarshalIndent(v, "", "  ")
-			if err != nil {
-				log.Fatalf(err.Error())
-			}
-			fmt.Println(string(indented_v))
-		}
-	}
-
-	switch v := p.Result.(type) {
-	case string:
-		fmt.Printf("Result: %s\n", v)
-	case Result_object:
-		fmt.Printf("Result_object:")
-		indented_v, err := json.MarshalIndent(v, "", "  ")
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
-		fmt.Println(string(indented_v))
-	}
-
-	if p.Error.Message != "" {
-		fmt.Printf("Error: %s\n", p.Error.Message)
-	}
-
-	if p.Id != 0 {
-		fmt.Printf("Id: %d\n", p.Id)
-	}
-	fmt.Print("\n")
-}
-
 func (p *Jsonrpc) Add_method(method string) {
 	p.Method = method
 }
@@ -182,20 +153,27 @@ func (p *Jsonrpc) Add_params_filename(filename string) {
 	p.Params = *Params_object
 }
 
+func (p *Jsonrpc) Add_params_root(root string) {
+	Params_object := new(Params_object)
+	Params_object.Root = root
+	p.Params = *Params_object
+}
+
 /* Creates the following struct for the Params field of a Jsonrpc object
 {
 	params: {
 		objects: {
-			webhooks = nil, virtual_sdcard = nil, print_stats = nil,
+			print_stats = nil, webhooks = nil, ...
 		}
 	}
 }
+A nil object asks Moonraker for all of its fields
 */
-func (p *Jsonrpc) Adds_params_objects() {
-	obj := new(Objects_object)
-	obj.Webhooks = nil
-	obj.Virtual_sdcard = nil
-	obj.Print_stats = nil
+func (p *Jsonrpc) Add_params_objects(objects ...string) {
+	obj := make(map[string]interface{})
+	for _, name := range objects {
+		obj[name] = nil
+	}
 	po := new(Params_object)
 	po.Objects = obj
 	p.Params = po
@@ -223,16 +201,22 @@ func (ro *Result_object) Create_status_object() {
 }
 
 func (ro *Result_object) get_status_code() int {
-	switch ro.Status.Print_stats.State {
+	return status_code(ro.Status.Print_stats.State)
+}
+
+// Maps a print_stats state string to a printer status code
+func status_code(state string) int {
+	switch state {
 	case "standby":
 		return Standby
 	case "printing":
 		return Printing
 	case "paused":
 		return Paused
-	case "completed":
+	// Klipper reports "complete" and "cancelled"
+	case "complete", "completed":
 		return Completed
-	case "canceled":
+	case "cancelled", "canceled":
 		return Canceled
 	case "error":
 		return E
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"math/rand"
 	"time"
 
@@ -11,7 +10,7 @@ import (
 
 var letters = []rune("1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
-func addFalseDocumentToJobsCollection(ctx context.Context, client *firestore.Client) {
+func addFalseDocumentToJobsCollection(ctx context.Context, client *firestore.Client) string {
 	// Properly generate random string
 	rand.Seed(time.Now().UnixNano())
 
@@ -21,6 +20,20 @@ func addFalseDocumentToJobsCollection(ctx context.Context, client *firestore.Cli
 	newDocument := jobCollection.Doc(generateString(20))
 
 	// Write default values to doc
+	doc := falseJobDocument()
+
+	// Push new dummy order to our "jobs" collection
+	wr, err := newDocument.Create(ctx, doc)
+	if err != nil {
+		logger.Error("adding job: ", err)
+		return ""
+	}
+	jobLog(newDocument.ID).Info("added at ", wr.UpdateTime)
+	return newDocument.ID
+}
+
+// A dummy order with one file, as the storefront writes them
+func falseJobDocument() map[string]interface{} {
 	doc := make(map[string]interface{})
 	doc["gcode"] = []interface{}{map[string]interface{}{
 		"filament": map[string]interface{}{
@@ -38,13 +51,7 @@ func addFalseDocumentToJobsCollection(ctx context.Context, client *firestore.Cli
 		},
 	}}
 	doc["status"] = 0
-
-	// Push new dummy order to our "jobs" collection
-	wr, err := newDocument.Create(ctx, doc)
-	if err != nil {
-		fmt.Println(err)
-	}
-	fmt.Println(wr.UpdateTime)
+	return doc
 }
 
 // Generates a random string to be used as a collection id within "jobs" collection
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Names for the printer status codes, as the API reports them
+var printerStatusNames = map[int]string{
+	Standby:     "standby",
+	Printing:    "printing",
+	Completed:   "completed",
+	Paused:      "paused",
+	Canceled:    "canceled",
+	Setup:       "setup",
+	Resetting:   "resetting",
+	Maintenance: "maintenance",
+	E:           "error",
+}
+
+func printerStatusName(status int) string {
+	if name, ok := printerStatusNames[status]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+var (
+	errNotFound        = errors.New("not found")
+	errFileNotFinished = errors.New("file is waiting or printing")
+	errFileOnPrinter   = errors.New("file is still on its printer")
+	errJobIsCanceled   = errors.New("job is canceled")
+)
+
+// A printer as GET /printers reports it
+type printerView struct {
+	Id                string          `json:"id"`
+	Name              string          `json:"name"`
+	Host              string          `json:"host"`
+	Port              string          `json:"port"`
+	Online            bool            `json:"online"`
+	Status            string          `json:"status"`
+	State             string          `json:"state"` // what the printer itself reports
+	LastMaterial      string          `json:"last_material"`
+	LastColor         string          `json:"last_color"`
+	CurrentFile       *fileView       `json:"current_file"`
+	Progress          float64         `json:"progress"`
+	HotendTemp        float64         `json:"hotend_temp"`
+	HotendTarget      float64         `json:"hotend_target"`
+	BedTemp           float64         `json:"bed_temp"`
+	BedTarget         float64         `json:"bed_target"`
+	IdleFlag          bool            `json:"idle_flag"`
+	MaintenanceReason string          `json:"maintenance_reason,omitempty"`
+	Draining          bool            `json:"draining,omitempty"` // left the config, goes once done
+	Upload            *UploadProgress `json:"upload,omitempty"`
+}
+
+// A file as the API reports it, with what identifies it in its job
+type fileView struct {
+	JobId     string `json:"job_id"`
+	FileIndex int    `json:"file_index"`
+	GcodeFile
+}
+
+// A queued file with its place in line
+type queueView struct {
+	fileView
+	Position       int        `json:"position"`
+	Priority       int        `json:"priority"`
+	DueAt          time.Time  `json:"due_at"`
+	EnqueuedAt     time.Time  `json:"enqueued_at"`
+	StartsNow      bool       `json:"starts_now,omitempty"`
+	ProjectedStart *time.Time `json:"projected_start,omitempty"`
+}
+
+func newFileView(gcode GcodeFile) fileView {
+	return fileView{JobId: gcode.JobId, FileIndex: gcode.FileIndex, GcodeFile: gcode}
+}
+
+func newPrinterView(p *Print) printerView {
+	status := p.PrinterStatus()
+	color, material := p.LastUsed()
+	view := printerView{
+		Id:                p.Id,
+		Name:              p.Name(),
+		Host:              p.Host,
+		Port:              p.Port,
+		Online:            p.Online(),
+		Status:            printerStatusName(p.GetStatus()),
+		State:             printerStatusName(status.State),
+		LastMaterial:      material,
+		LastColor:         color,
+		Progress:          status.Progress,
+		HotendTemp:        status.HotendTemp,
+		HotendTarget:      status.HotendTarget,
+		BedTemp:           status.BedTemp,
+		BedTarget:         status.BedTarget,
+		IdleFlag:          status.IdleFlag,
+		MaintenanceReason: p.MaintenanceReason(),
+		Draining:          p.Draining(),
+		Upload:            status.Upload,
+	}
+	if gcode, ok := p.CurrentFile(); ok {
+		file := newFileView(gcode)
+		view.CurrentFile = &file
+	}
+	return view
+}
+
+// Serves the farm's state and controls over HTTP on api.port, until ctx is
+// done. Without a port there is no API
+func serveAPI(ctx context.Context, store JobStore) {
+	port := viper.GetInt("api.port")
+	if port == 0 {
+		return
+	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: newAPIHandler(ctx, store)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Infof("API listening on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error("API: ", err)
+	}
+}
+
+// Routes the API by hand:
+//
+//	GET  /printers
+//	POST /printers/{id}/{pause,resume,cancel,emergency_stop,clear,acknowledge}
+//	GET  /queue
+//	GET  /jobs/{id}
+//	POST /jobs/{id}/files/{index}/requeue
+//	GET  /events
+//	GET  /metrics
+//
+// Any other GET is for the dashboard
+func newAPIHandler(ctx context.Context, store JobStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.Method == "GET" && len(parts) == 1 && parts[0] == "printers":
+			views := []printerView{}
+			for _, p := range farm.Printers() {
+				views = append(views, newPrinterView(p))
+			}
+			writeJSON(w, http.StatusOK, views)
+		case r.Method == "POST" && len(parts) == 3 && parts[0] == "printers":
+			p := findPrinter(parts[1])
+			if p == nil {
+				writeError(w, http.StatusNotFound, errNotFound)
+				return
+			}
+			if err := printerAction(r.Context(), p, parts[2]); err != nil {
+				writeError(w, actionStatus(err), err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newPrinterView(p))
+		case r.Method == "GET" && len(parts) == 1 && parts[0] == "queue":
+			writeJSON(w, http.StatusOK, queueViews())
+		case r.Method == "GET" && len(parts) == 2 && parts[0] == "jobs":
+			job, ok := farm.Job(parts[1])
+			if !ok {
+				writeError(w, http.StatusNotFound, errNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, job)
+		case r.Method == "POST" && len(parts) == 5 && parts[0] == "jobs" && parts[2] == "files" && parts[4] == "requeue":
+			index, err := strconv.Atoi(parts[3])
+			if err != nil {
+				writeError(w, http.StatusNotFound, errNotFound)
+				return
+			}
+			// The write outlives the request; the snapshot queues the file
+			if err := requeueFile(ctx, store, parts[1], index); err != nil {
+				writeError(w, actionStatus(err), err)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == "GET" && len(parts) == 1 && parts[0] == "events":
+			serveEvents(ctx, w, r)
+		case r.Method == "GET" && len(parts) == 1 && parts[0] == "metrics":
+			metricsHandler.ServeHTTP(w, r)
+		case r.Method == "GET":
+			dashboard.ServeHTTP(w, r)
+		default:
+			writeError(w, http.StatusNotFound, errNotFound)
+		}
+	})
+}
+
+func findPrinter(id string) *Print {
+	for _, p := range farm.Printers() {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func printerAction(ctx context.Context, p *Print, action string) error {
+	switch action {
+	case "clear":
+		return p.ClearBed()
+	case "acknowledge":
+		return p.Acknowledge()
+	default:
+		return p.Control(ctx, action)
+	}
+}
+
+// The HTTP status for an error from an action
+func actionStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, ErrUnknownControl):
+		return http.StatusNotFound
+	case errors.Is(err, ErrBedNotWaiting), errors.Is(err, ErrNotInMaintenance),
+		errors.Is(err, errFileNotFinished), errors.Is(err, errFileOnPrinter),
+		errors.Is(err, errJobIsCanceled), errors.Is(err, ErrFileChanged):
+		return http.StatusConflict
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// The queue in print order, with where each file stands
+func queueViews() []queueView {
+	views := []queueView{}
+	for _, proj := range projectQueue(farm.Queue(), farm.Printers(), time.Now()) {
+		view := queueView{
+			fileView:   newFileView(proj.File),
+			Position:   proj.Position,
+			Priority:   proj.File.Priority,
+			DueAt:      proj.File.DueAt,
+			EnqueuedAt: proj.File.EnqueuedAt,
+			StartsNow:  proj.StartsNow,
+		}
+		if !proj.ProjectedStart.IsZero() {
+			start := proj.ProjectedStart
+			view.ProjectedStart = &start
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// Puts a finished file back in line as if it were new, forgetting the
+// printers it failed on
+func requeueFile(ctx context.Context, store JobStore, jobId string, index int) error {
+	job, ok := farm.Job(jobId)
+	if !ok || index < 0 || index >= len(job.GcodeFiles) {
+		return errNotFound
+	}
+	if job.Status == JobCanceled {
+		return errJobIsCanceled
+	}
+	gcode := job.GcodeFiles[index]
+	if !gcode.Finished() {
+		return errFileNotFinished
+	}
+	// Until the bed is cleared, the snapshot wouldn't queue it again
+	for _, a := range farm.ActiveForJob(jobId) {
+		if a.File.Key() == gcode.Key() {
+			return errFileOnPrinter
+		}
+	}
+	gcode.SetStatusMessage(GcodeIdle, "requeued by an operator")
+	gcode.Attempts = 0
+	gcode.FailedOn = nil
+	return UpdateFileStatus(gcode, ctx, store)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("API: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
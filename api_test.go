@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func apiRequest(t *testing.T, server *httptest.Server, method string, path string, want int, v interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != want {
+		t.Fatalf("%s %s: status %d, want %d", method, path, res.StatusCode, want)
+	}
+	if v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	store := NewMemoryStore()
+	doc := falseJobDocument()
+	files := doc["gcode"].([]interface{})
+	second := map[string]interface{}{}
+	for k, v := range files[0].(map[string]interface{}) {
+		second[k] = v
+	}
+	second["filename"] = "second.gcode"
+	doc["gcode"] = append(files, second)
+	store.PutJob(jobFromFalseDocument(t, "job-1", doc))
+
+	d := newFakeDriver("printer-0")
+	startFarm(t, store, d)
+	server := httptest.NewServer(newAPIHandler(context.Background(), store))
+	defer server.Close()
+	waitFor(t, "print to start", func() bool { return d.Status().State == Printing })
+	waitFor(t, "second file to be queued", func() bool { return farm.QueueLen() == 1 })
+
+	var printers []printerView
+	apiRequest(t, server, "GET", "/printers", http.StatusOK, &printers)
+	if len(printers) != 1 || printers[0].Status != "printing" || printers[0].CurrentFile == nil ||
+		printers[0].CurrentFile.Filename != "testing.gcode" || printers[0].LastMaterial != "PLA" {
+		t.Errorf("printers = %+v", printers)
+	}
+	var queue []queueView
+	apiRequest(t, server, "GET", "/queue", http.StatusOK, &queue)
+	if len(queue) != 1 || queue[0].FileIndex != 1 || queue[0].Position != 1 {
+		t.Errorf("queue = %+v", queue)
+	}
+
+	res, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	for _, want := range []string{
+		`farm_prints_started_total{material="PLA",printer="0"}`,
+		`farm_printer_status{printer="0"} 1`,
+		`farm_queue_depth 1`,
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+
+	apiRequest(t, server, "POST", "/printers/0/pause", http.StatusOK, nil)
+	waitFor(t, "file to be paused", fileHasStatus(store, "job-1", 0, GcodePaused))
+	apiRequest(t, server, "POST", "/printers/0/resume", http.StatusOK, nil)
+	waitFor(t, "file to resume", fileHasStatus(store, "job-1", 0, GcodePrinting))
+	apiRequest(t, server, "POST", "/printers/0/clear", http.StatusConflict, nil)
+	apiRequest(t, server, "POST", "/printers/0/launch", http.StatusNotFound, nil)
+	apiRequest(t, server, "POST", "/printers/9/pause", http.StatusNotFound, nil)
+
+	d.update(func(s *PrinterStatus) {
+		s.State = E
+		s.Message = "Move out of range"
+	})
+	waitFor(t, "file to fail", fileHasStatus(store, "job-1", 0, GcodeError))
+	apiRequest(t, server, "POST", "/printers/0/acknowledge", http.StatusOK, nil)
+	waitFor(t, "second file to start", fileHasStatus(store, "job-1", 1, GcodePrinting))
+
+	apiRequest(t, server, "POST", "/jobs/job-1/files/1/requeue", http.StatusConflict, nil)
+	apiRequest(t, server, "POST", "/jobs/job-1/files/0/requeue", http.StatusAccepted, nil)
+	waitFor(t, "failed file to be queued again", func() bool { return farm.QueueLen() == 1 })
+
+	var job Job
+	apiRequest(t, server, "GET", "/jobs/job-1", http.StatusOK, &job)
+	if len(job.GcodeFiles) != 2 || job.GcodeFiles[0].Status != GcodeIdle || job.GcodeFiles[0].Attempts != 0 {
+		t.Errorf("job = %+v", job)
+	}
+	apiRequest(t, server, "GET", "/jobs/job-2", http.StatusNotFound, nil)
+}
+
+func TestDashboardEvents(t *testing.T) {
+	store := NewMemoryStore()
+	d := newFakeDriver("printer-0")
+	startFarm(t, store, d)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(newAPIHandler(ctx, store))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("GET / = %d %s, want the dashboard", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	// A stream that never shows the change fails the test instead of hanging
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err = client.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	events := bufio.NewScanner(res.Body)
+	nextState := func() dashboardState {
+		t.Helper()
+		for events.Scan() {
+			if data := strings.TrimPrefix(events.Text(), "data: "); data != events.Text() {
+				var state dashboardState
+				if err := json.Unmarshal([]byte(data), &state); err != nil {
+					t.Fatal(err)
+				}
+				return state
+			}
+		}
+		t.Fatal("event stream ended")
+		return dashboardState{}
+	}
+
+	if state := nextState(); len(state.Printers) != 1 || len(state.Jobs) != 0 {
+		t.Errorf("first state = %+v", state)
+	}
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	for {
+		state := nextState()
+		if len(state.Printers) == 1 && state.Printers[0].CurrentFile != nil && len(state.Jobs) == 1 {
+			break
+		}
+	}
+	// Cut the stream before the farm goes away
+	cancel()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// What a printer can physically take on, from its [printers.N] block
+type Capabilities struct {
+	// Zero dimensions fall back to [printer_dimensions]
+	BuildVolume MaxDim
+	// Nozzle diameter in mm, 0 when not declared
+	Nozzle float64
+	// Materials the printer runs; empty accepts any
+	Materials []string
+}
+
+// Build volume to use when a printer doesn't declare one
+func defaultBuildVolume() MaxDim {
+	return currentSettings().BuildVolume
+}
+
+// Whether the part fits the build volume. The footprint may be turned 90
+// degrees on the bed; height is fixed. A volume with no dimensions set
+// accepts anything
+func (c Capabilities) Fits(dim MaxDim) bool {
+	volume := c.BuildVolume
+	if volume == (MaxDim{}) {
+		volume = defaultBuildVolume()
+	}
+	if volume == (MaxDim{}) {
+		return true
+	}
+	if volume.Height > 0 && dim.Height > volume.Height {
+		return false
+	}
+	return fitsFootprint(dim.Length, dim.Width, volume.Length, volume.Width) ||
+		fitsFootprint(dim.Width, dim.Length, volume.Length, volume.Width)
+}
+
+func fitsFootprint(length float64, width float64, maxLength float64, maxWidth float64) bool {
+	return (maxLength == 0 || length <= maxLength) && (maxWidth == 0 || width <= maxWidth)
+}
+
+func (c Capabilities) AcceptsMaterial(material string) bool {
+	if len(c.Materials) == 0 || material == "" {
+		return true
+	}
+	for _, m := range c.Materials {
+		if strings.EqualFold(m, material) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Capabilities) HasNozzle(nozzle float64) bool {
+	return nozzle == 0 || c.Nozzle == 0 || math.Abs(c.Nozzle-nozzle) < 0.001
+}
+
+// Whether the printer can print the file at all, ignoring what it is
+// doing right now
+func (c Capabilities) CanPrint(GF GcodeFile) bool {
+	return c.Fits(GF.MaxDim) && c.AcceptsMaterial(GF.Material) && c.HasNozzle(GF.Nozzle)
+}
+
+// Explains why no printer in the list can take the file, or returns "" if
+// one can
+func unfitReason(GF GcodeFile, printers []*Print) string {
+	fits, material, nozzle := false, false, false
+	for _, p := range printers {
+		c := p.Capabilities()
+		if c.CanPrint(GF) {
+			return ""
+		}
+		fits = fits || c.Fits(GF.MaxDim)
+		material = material || c.AcceptsMaterial(GF.Material)
+		nozzle = nozzle || c.HasNozzle(GF.Nozzle)
+	}
+	switch {
+	case len(printers) == 0:
+		return "no printers configured"
+	case !fits:
+		return fmt.Sprintf("part %gx%gx%g mm (LxWxH) fits no printer's build volume",
+			GF.MaxDim.Length, GF.MaxDim.Width, GF.MaxDim.Height)
+	case !material:
+		return fmt.Sprintf("no printer runs %s", GF.Material)
+	case !nozzle:
+		return fmt.Sprintf("no printer has a %g mm nozzle", GF.Nozzle)
+	default:
+		return "no single printer meets the part's size, material and nozzle together"
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCapabilitiesFits(t *testing.T) {
+	bed := Capabilities{BuildVolume: MaxDim{Height: 200, Length: 250, Width: 210}}
+	tests := []struct {
+		name string
+		caps Capabilities
+		dim  MaxDim
+		want bool
+	}{
+		{"equal to the limit", bed, MaxDim{Height: 200, Length: 250, Width: 210}, true},
+		{"well inside", bed, MaxDim{Height: 10, Length: 10, Width: 10}, true},
+		{"height over", bed, MaxDim{Height: 200.1, Length: 250, Width: 210}, false},
+		{"length over", bed, MaxDim{Height: 200, Length: 250.1, Width: 100}, false},
+		{"width over", bed, MaxDim{Height: 200, Length: 100, Width: 250.1}, false},
+		{"footprint turned to fit", bed, MaxDim{Height: 200, Length: 210, Width: 250}, true},
+		{"footprint over either way", bed, MaxDim{Height: 200, Length: 240, Width: 240}, false},
+		{"unknown height", Capabilities{BuildVolume: MaxDim{Length: 250, Width: 210}},
+			MaxDim{Height: 1000, Length: 250, Width: 210}, true},
+		{"unknown width", Capabilities{BuildVolume: MaxDim{Height: 200, Length: 250}},
+			MaxDim{Height: 200, Length: 250, Width: 1000}, true},
+		{"unknown volume without a default", Capabilities{},
+			MaxDim{Height: 1000, Length: 1000, Width: 1000}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.caps.Fits(tt.dim); got != tt.want {
+			t.Errorf("%s: Fits(%+v) = %v, want %v", tt.name, tt.dim, got, tt.want)
+		}
+	}
+}
+
+func TestCapabilitiesFitsDefaultVolume(t *testing.T) {
+	viper.Set("printer_dimensions.height", 200)
+	viper.Set("printer_dimensions.length", 250)
+	viper.Set("printer_dimensions.width", 210)
+	loadSettings()
+	t.Cleanup(func() {
+		viper.Set("printer_dimensions.height", 0)
+		viper.Set("printer_dimensions.length", 0)
+		viper.Set("printer_dimensions.width", 0)
+		loadSettings()
+	})
+
+	if !(Capabilities{}).Fits(MaxDim{Height: 200, Length: 250, Width: 210}) {
+		t.Error("part equal to the default volume doesn't fit")
+	}
+	if (Capabilities{}).Fits(MaxDim{Height: 201, Length: 250, Width: 210}) {
+		t.Error("part over the default volume fits")
+	}
+	// A declared volume is used instead of the default
+	big := Capabilities{BuildVolume: MaxDim{Height: 400, Length: 400, Width: 400}}
+	if !big.Fits(MaxDim{Height: 300, Length: 300, Width: 300}) {
+		t.Error("part within a declared volume over the default doesn't fit")
+	}
+}
+
+func TestUnfitReason(t *testing.T) {
+	printer := func(caps Capabilities) *Print {
+		return newPrint(PrinterConfig{Id: "0", Capabilities: caps}, newFakeDriver("printer-0"))
+	}
+	small := Capabilities{BuildVolume: MaxDim{Height: 100, Length: 100, Width: 100}}
+	petg := Capabilities{Materials: []string{"PETG"}}
+	nozzle := Capabilities{Nozzle: 0.6}
+	file := GcodeFile{
+		Nozzle:   0.4,
+		Filament: Filament{Material: "PLA"},
+		MaxDim:   MaxDim{Height: 150, Length: 120, Width: 80},
+	}
+
+	tests := []struct {
+		name     string
+		printers []*Print
+		want     string
+	}{
+		{"no printers", nil, "no printers configured"},
+		{"one printer can take it", []*Print{printer(small), printer(Capabilities{})}, ""},
+		{"too big for all", []*Print{printer(small)}, "part 120x80x150 mm (LxWxH) fits no printer's build volume"},
+		{"material runs nowhere", []*Print{printer(petg)}, "no printer runs PLA"},
+		{"material matched case-insensitively", []*Print{printer(Capabilities{Materials: []string{"pla"}})}, ""},
+		{"nozzle nowhere", []*Print{printer(nozzle)}, "no printer has a 0.4 mm nozzle"},
+		{"each need met apart", []*Print{printer(small), printer(petg), printer(nozzle)},
+			"no single printer meets the part's size, material and nozzle together"},
+	}
+	for _, tt := range tests {
+		if got := unfitReason(file, tt.printers); got != tt.want {
+			t.Errorf("%s: unfitReason = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
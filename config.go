@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Settings the node reads as it runs. Viper can't be read safely while
+// WatchConfig rewrites it, so they are copied out by loadSettings when the
+// config is read and again whenever it changes
+type Settings struct {
+	// [printer_dimensions], for printers that don't declare a build volume
+	BuildVolume MaxDim
+	// failure.max_attempts, prints of a file before it fails for good
+	MaxFailedAttempts int
+	// upload.max_attempts, 0 for defaultUploadAttempts
+	MaxUploadAttempts int
+	// startup.printer_timeout, how long printers get to say what they are
+	// printing
+	PrinterTimeout time.Duration
+}
+
+var settings struct {
+	sync.Mutex
+	current Settings
+}
+
+func loadSettings() {
+	s := Settings{
+		BuildVolume: MaxDim{
+			Height: viper.GetFloat64("printer_dimensions.height"),
+			Length: viper.GetFloat64("printer_dimensions.length"),
+			Width:  viper.GetFloat64("printer_dimensions.width"),
+		},
+		MaxFailedAttempts: viper.GetInt("failure.max_attempts"),
+		MaxUploadAttempts: viper.GetInt("upload.max_attempts"),
+		PrinterTimeout:    defaultStartupTimeout,
+	}
+	if viper.IsSet("startup.printer_timeout") {
+		s.PrinterTimeout = viper.GetDuration("startup.printer_timeout")
+	}
+	settings.Lock()
+	settings.current = s
+	settings.Unlock()
+}
+
+func currentSettings() Settings {
+	settings.Lock()
+	defer settings.Unlock()
+	return settings.current
+}
+
+// Settings from one [printers.N] block of the config
+type PrinterConfig struct {
+	Id     string
+	Driver string // "moonraker" (default) or "octoprint"
+	Host   string
+	Port   string
+	ApiKey string // OctoPrint only
+
+	Capabilities
+}
+
+// Reads every [printers.N] block, ordered by N
+func loadPrinterConfigs() []PrinterConfig {
+	printers := viper.GetStringMap("printers")
+
+	ids := make([]string, 0, len(printers))
+	for id := range printers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	configs := make([]PrinterConfig, 0, len(ids))
+	for _, id := range ids {
+		key := "printers." + id + "."
+		configs = append(configs, PrinterConfig{
+			Id:     id,
+			Driver: viper.GetString(key + "driver"),
+			Host:   viper.GetString(key + "host"),
+			Port:   viper.GetString(key + "port"),
+			ApiKey: viper.GetString(key + "api_key"),
+			Capabilities: Capabilities{
+				BuildVolume: MaxDim{
+					Height: viper.GetFloat64(key + "height"),
+					Length: viper.GetFloat64(key + "length"),
+					Width:  viper.GetFloat64(key + "width"),
+				},
+				Nozzle:    viper.GetFloat64(key + "nozzle"),
+				Materials: viper.GetStringSlice(key + "materials"),
+			},
+		})
+	}
+	return configs
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Commands for a running print, written to a job's control field or sent
+// through the local API
+const (
+	ControlPause         = "pause"
+	ControlResume        = "resume"
+	ControlCancel        = "cancel"
+	ControlEmergencyStop = "emergency_stop"
+)
+
+var ErrUnknownControl = errors.New("unknown control")
+
+// Jobs whose control command is being carried out, so the job changes it
+// causes before it is cleared don't carry it out again
+var controlling = struct {
+	sync.Mutex
+	jobs map[string]string
+}{jobs: make(map[string]string)}
+
+func (p *Print) Pause(ctx context.Context) error {
+	return p.driver.Pause(ctx)
+}
+
+func (p *Print) Resume(ctx context.Context) error {
+	return p.driver.Resume(ctx)
+}
+
+// Cancels the print. A file the farm is handling is withdrawn, which also
+// covers one still being set up; anything else is canceled on the printer
+func (p *Print) Cancel(ctx context.Context) error {
+	if GF, ok := p.CurrentFile(); ok && p.Withdraw(GF) {
+		return nil
+	}
+	return p.driver.Cancel(ctx)
+}
+
+// Halts the printer. The print fails and the printer needs a restart at
+// the machine before it can take work again
+func (p *Print) EmergencyStop(ctx context.Context) error {
+	return p.driver.EmergencyStop(ctx)
+}
+
+// Carries out one of the Control commands
+func (p *Print) Control(ctx context.Context, control string) error {
+	switch control {
+	case ControlPause:
+		return p.Pause(ctx)
+	case ControlResume:
+		return p.Resume(ctx)
+	case ControlCancel:
+		return p.Cancel(ctx)
+	case ControlEmergencyStop:
+		return p.EmergencyStop(ctx)
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownControl, control)
+	}
+}
+
+// Carries out the control command on a job document for each of the job's
+// running prints, then clears it so it isn't carried out again. A command
+// that arrives with nothing running is dropped
+func controlJob(job Job, ctx context.Context, store JobStore) {
+	controlling.Lock()
+	if controlling.jobs[job.JobId] == job.Control {
+		controlling.Unlock()
+		return
+	}
+	controlling.jobs[job.JobId] = job.Control
+	controlling.Unlock()
+	defer func() {
+		controlling.Lock()
+		delete(controlling.jobs, job.JobId)
+		controlling.Unlock()
+	}()
+
+	for _, a := range farm.ActiveForJob(job.JobId) {
+		if err := a.Printer.Control(ctx, job.Control); err != nil {
+			a.Printer.log().WithFields(fileFields(a.File)).Errorf("%s: %v", job.Control, err)
+			continue
+		}
+		a.Printer.log().WithFields(fileFields(a.File)).Infof("%s sent", job.Control)
+	}
+	if err := store.ClearControl(ctx, job.JobId, job.Control); err != nil {
+		jobLog(job.JobId).Error("control not cleared: ", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// The dashboard is built into the binary, with nothing loaded from outside,
+// so it works on a LAN without internet access
+//
+//go:embed web
+var webFiles embed.FS
+
+var dashboard = func() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}()
+
+// Changes closer together than this go out as one event
+const eventCoalesce = 250 * time.Millisecond
+
+// Keeps idle event streams from being closed by proxies
+const eventHeartbeat = 15 * time.Second
+
+// Everything the dashboard shows, sent whole on every change
+type dashboardState struct {
+	Printers []printerView `json:"printers"`
+	Queue    []queueView   `json:"queue"`
+	Jobs     []Job         `json:"jobs"`
+}
+
+func newDashboardState() dashboardState {
+	state := dashboardState{Printers: []printerView{}, Queue: queueViews(), Jobs: farm.Jobs()}
+	for _, p := range farm.Printers() {
+		state.Printers = append(state.Printers, newPrinterView(p))
+	}
+	sort.Slice(state.Jobs, func(i, j int) bool { return state.Jobs[i].JobId < state.Jobs[j].JobId })
+	return state
+}
+
+// Streams the dashboard state as server-sent events, a new "state" event
+// each time a printer, the queue or a job changes
+func serveEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	var last []byte
+	var changed <-chan struct{}
+	for {
+		// Watch for the next change before reading the state, so none
+		// slips in between
+		if changed == nil {
+			changed = farmChanged(r.Context().Done())
+		}
+		data, err := json.Marshal(newDashboardState())
+		if err != nil {
+			return
+		}
+		// Most printer updates are temperatures wobbling in place
+		if !bytes.Equal(data, last) {
+			last = data
+			if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+			changed = nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			continue
+		case <-r.Context().Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-time.After(eventCoalesce):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Returns a channel that is closed on the next change to anything the
+// dashboard shows, or once done is
+func farmChanged(done <-chan struct{}) <-chan struct{} {
+	waits := []<-chan struct{}{done, printerUpdates.Wait(), farm.QueueChanged(), farm.JobsChanged()}
+	for _, p := range farm.Printers() {
+		waits = append(waits, p.StatusChanged())
+	}
+	cases := make([]reflect.SelectCase, len(waits))
+	for i, wait := range waits {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(wait)}
+	}
+	changed := make(chan struct{})
+	go func() {
+		reflect.Select(cases)
+		close(changed)
+	}()
+	return changed
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNotInMaintenance = errors.New("printer is not in maintenance")
+
+// Takes the printer out of the pool after a print failed on it and records
+// why. With failure.max_attempts set, a file that hasn't used them up is
+// put back in the queue for another printer instead of failing. The
+// printer stays in Maintenance until someone acknowledges it
+func (p *Print) fail(GF GcodeFile, status PrinterStatus, ctx context.Context, store JobStore) {
+	reason := failureReason(status)
+	p.mu.Lock()
+	p.maintenanceReason = reason
+	p.mu.Unlock()
+	p.SetStatus(Maintenance)
+	p.log().WithFields(fileFields(GF)).Errorf("failed printing %s: %s", GF.Filename, reason)
+	p.failFile(GF, reason, ctx, store)
+
+	if err := p.waitForAcknowledge(ctx); err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.maintenanceReason = ""
+	p.mu.Unlock()
+	p.SetStatus(Standby)
+}
+
+// Counts a failed attempt at GF on the printer. The file goes back in the
+// queue if shouldRetry lets it, and fails with reason otherwise
+func (p *Print) failFile(GF GcodeFile, reason string, ctx context.Context, store JobStore) {
+	// Let go of the file first, so the snapshot of this update can queue
+	// it again, now or when it is requeued by hand
+	p.finishFile(GF)
+	GF.Attempts++
+	GF.FailedOn = append(append([]string(nil), GF.FailedOn...), p.Id)
+	retry, unfit := shouldRetry(GF)
+	switch {
+	case retry:
+		// Not a failure of the file yet, but of the print
+		printsFinished.WithLabelValues(p.Id, GF.Material, "errored").Inc()
+		GF.SetStatusMessage(GcodeIdle, fmt.Sprintf("attempt %d failed on printer %s: %s", GF.Attempts, p.Id, reason))
+	case unfit != "":
+		GF.SetStatusMessage(GcodeError, fmt.Sprintf("%s after attempt %d failed on printer %s: %s", unfit, GF.Attempts, p.Id, reason))
+	default:
+		GF.SetStatusMessage(GcodeError, reason)
+	}
+	UpdateFileStatus(GF, ctx, store)
+}
+
+// What Klipper said went wrong: print_stats.message, and
+// webhooks.state_message when it adds something
+func failureReason(status PrinterStatus) string {
+	var parts []string
+	if status.Message != "" {
+		parts = append(parts, status.Message)
+	}
+	if status.StateMessage != "" && status.StateMessage != status.Message {
+		parts = append(parts, status.StateMessage)
+	}
+	if len(parts) == 0 {
+		return "printer reported an error"
+	}
+	return strings.Join(parts, ": ")
+}
+
+// Whether a failed file has attempts left and a printer it hasn't failed
+// on that can take it. If only the printers left can't take it, also says
+// why, as unfitReason does
+func shouldRetry(GF GcodeFile) (bool, string) {
+	if GF.Attempts >= currentSettings().MaxFailedAttempts {
+		return false, ""
+	}
+	var others []*Print
+	for _, p := range farm.Printers() {
+		if !GF.FailedOnPrinter(p.Id) && !p.Draining() {
+			others = append(others, p)
+		}
+	}
+	if len(others) == 0 {
+		return false, ""
+	}
+	// Printers may only be gone for a moment while the config is reloaded;
+	// the queue checks the file again once the list has settled
+	if reason := unfitReason(GF, others); reason != "" && farm.PrintersSettling() == 0 {
+		return false, reason
+	}
+	return true, ""
+}
+
+// Why the printer is in Maintenance, empty when it isn't
+func (p *Print) MaintenanceReason() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maintenanceReason
+}
+
+// Puts a printer held in Maintenance back in the pool
+func (p *Print) Acknowledge() error {
+	return p.releaseFrom(Maintenance, ErrNotInMaintenance)
+}
+
+// Blocks until the failure is acknowledged, either through Acknowledge or
+// at the machine: Klipper restarted and the bed cleared
+func (p *Print) waitForAcknowledge(ctx context.Context) error {
+	return p.waitForRelease(ctx, func(status PrinterStatus) bool {
+		return status.State != E && status.IdleFlag
+	})
+}
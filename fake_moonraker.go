@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long a simulated print takes when its G-code doesn't say
+const defaultFakePrintTime = 10 * time.Minute
+
+// How often a simulated print moves along
+const fakeTick = 100 * time.Millisecond
+
+// FakeMoonraker simulates a Klipper printer behind Moonraker, enough for
+// the Moonraker driver to upload, start and follow prints on it. Prints
+// advance on their own, Speed times faster than the estimated print time
+// in the G-code. With AutoOperate set, a simulated technician acknowledges
+// the display notification and clears the bed after AckDelay
+type FakeMoonraker struct {
+	Speed       float64
+	AutoOperate bool
+	AckDelay    time.Duration
+
+	mu       sync.Mutex
+	files    map[string]fakeFile
+	state    string // print_stats.state
+	message  string // print_stats.message
+	filename string
+	progress float64
+	duration time.Duration // estimated time of the current print
+	display  string
+	idleFlag bool
+	clients  map[*fakeClient]bool
+
+	server   *http.Server
+	listener net.Listener
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type fakeFile struct {
+	size     int64
+	duration time.Duration
+	modified time.Time
+}
+
+// A websocket session with the objects it subscribed to. Messages go out
+// in order through out, so a stale status never lands after a newer one
+type fakeClient struct {
+	ws      *websocket.Conn
+	out     chan Jsonrpc
+	objects []string
+}
+
+func NewFakeMoonraker() *FakeMoonraker {
+	return &FakeMoonraker{
+		Speed:       1,
+		AutoOperate: true,
+		files:       make(map[string]fakeFile),
+		state:       "standby",
+		idleFlag:    true,
+		clients:     make(map[*fakeClient]bool),
+		done:        make(chan struct{}),
+	}
+}
+
+// Starts serving on addr, "127.0.0.1:0" for any free port, and returns
+// the address it listens on
+func (f *FakeMoonraker) Listen(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	f.listener = listener
+	f.server = &http.Server{Handler: f}
+	go f.server.Serve(listener)
+	go f.run()
+	return listener.Addr().String(), nil
+}
+
+// Host and port, split the way PrinterConfig holds them
+func (f *FakeMoonraker) HostPort() (string, string) {
+	host, port, _ := net.SplitHostPort(f.listener.Addr().String())
+	return host, port
+}
+
+// Stops the server and drops every client
+func (f *FakeMoonraker) Close() {
+	f.stopOnce.Do(func() {
+		close(f.done)
+		if f.server != nil {
+			f.server.Close()
+		}
+		f.mu.Lock()
+		for c := range f.clients {
+			c.ws.Close()
+		}
+		f.mu.Unlock()
+	})
+}
+
+func (f *FakeMoonraker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/websocket":
+		f.serveWebsocket(w, r)
+	case "/server/files/upload":
+		f.serveUpload(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Stores an upload, checking its checksum the way Moonraker does
+func (f *FakeMoonraker) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if checksum := r.FormValue("checksum"); checksum != "" {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != strings.ToLower(checksum) {
+			http.Error(w, "checksum mismatch", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	duration := estimatedPrintTime(data)
+	if duration <= 0 {
+		duration = defaultFakePrintTime
+	}
+	f.mu.Lock()
+	f.files[header.Filename] = fakeFile{size: int64(len(data)), duration: duration, modified: time.Now()}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"item":   map[string]interface{}{"path": header.Filename, "root": "gcodes"},
+		"action": "create_file",
+	})
+}
+
+var (
+	// Cura: ";TIME:1234" in seconds
+	curaTime = regexp.MustCompile(`(?m)^;TIME:(\d+)`)
+	// PrusaSlicer and SuperSlicer: "; estimated printing time (normal mode) = 1d 2h 3m 4s"
+	prusaTime = regexp.MustCompile(`(?m)^; estimated printing time[^=]*=\s*(.+)$`)
+	prusaPart = regexp.MustCompile(`(\d+)([dhms])`)
+)
+
+// Reads the slicer's print time estimate from the G-code, 0 if it has none
+func estimatedPrintTime(data []byte) time.Duration {
+	if m := curaTime.FindSubmatch(data); m != nil {
+		seconds, _ := strconv.Atoi(string(m[1]))
+		return time.Duration(seconds) * time.Second
+	}
+	if m := prusaTime.FindSubmatch(data); m != nil {
+		units := map[string]time.Duration{"d": 24 * time.Hour, "h": time.Hour, "m": time.Minute, "s": time.Second}
+		var total time.Duration
+		for _, part := range prusaPart.FindAllStringSubmatch(string(m[1]), -1) {
+			n, _ := strconv.Atoi(part[1])
+			total += time.Duration(n) * units[part[2]]
+		}
+		return total
+	}
+	return 0
+}
+
+var fakeUpgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+func (f *FakeMoonraker) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := fakeUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &fakeClient{ws: ws, out: make(chan Jsonrpc, 256)}
+	f.mu.Lock()
+	f.clients[c] = true
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.clients, c)
+		close(c.out)
+		f.mu.Unlock()
+		ws.Close()
+	}()
+	go func() {
+		for data := range c.out {
+			ws.WriteJSON(data)
+		}
+	}()
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req struct {
+			Method string          `json:"method"`
+			Id     int             `json:"id"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(message, &req); err != nil {
+			continue
+		}
+		var params struct {
+			Script   string                 `json:"script"`
+			Filename string                 `json:"filename"`
+			Objects  map[string]interface{} `json:"objects"`
+		}
+		if len(req.Params) > 0 {
+			json.Unmarshal(req.Params, &params)
+		}
+
+		f.mu.Lock()
+		result, rpcErr := f.handleLocked(c, req.Method, params.Script, params.Filename, params.Objects)
+		c.send(Jsonrpc{Jsonrpc: "2.0", Id: req.Id, Result: result, Error: rpcErr})
+		f.mu.Unlock()
+	}
+}
+
+// Answers one JSON RPC request
+func (f *FakeMoonraker) handleLocked(c *fakeClient, method, script, filename string, objects map[string]interface{}) (interface{}, *Error_object) {
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch method {
+	case "printer.objects.subscribe":
+		c.objects = names
+		return map[string]interface{}{"eventtime": eventtime(), "status": f.objectsLocked(names)}, nil
+	case "printer.objects.query":
+		return map[string]interface{}{"eventtime": eventtime(), "status": f.objectsLocked(names)}, nil
+	case "printer.print.start":
+		file, ok := f.files[filename]
+		if !ok {
+			return nil, &Error_object{Code: 400, Message: "file not found: " + filename}
+		}
+		if f.state == "printing" || f.state == "paused" {
+			return nil, &Error_object{Code: 400, Message: "Printer busy"}
+		}
+		if f.state == "error" {
+			return nil, &Error_object{Code: 400, Message: "Klippy not ready"}
+		}
+		f.state = "printing"
+		f.message = ""
+		f.filename = filename
+		f.progress = 0
+		f.duration = file.duration
+	case "printer.print.pause":
+		if f.state == "printing" {
+			f.state = "paused"
+		}
+	case "printer.print.resume":
+		if f.state == "paused" {
+			f.state = "printing"
+		}
+	case "printer.print.cancel":
+		if f.state == "printing" || f.state == "paused" {
+			f.state = "cancelled"
+			f.operateLocked(f.clearBedLocked)
+		}
+	case "printer.emergency_stop":
+		f.shutdownLocked("Shutdown due to M112 command")
+	case "printer.gcode.script":
+		f.scriptLocked(script)
+	case "server.files.metadata":
+		file, ok := f.files[filename]
+		if !ok {
+			return nil, &Error_object{Code: 404, Message: "Metadata not available for " + filename}
+		}
+		return map[string]interface{}{
+			"filename":       filename,
+			"size":           file.size,
+			"modified":       float64(file.modified.Unix()),
+			"estimated_time": file.duration.Seconds(),
+		}, nil
+	case "server.files.list":
+		list := []interface{}{}
+		for name, file := range f.files {
+			list = append(list, map[string]interface{}{"path": name, "size": file.size, "modified": float64(file.modified.Unix())})
+		}
+		return list, nil
+	default:
+		return nil, &Error_object{Code: -32601, Message: "Method not found: " + method}
+	}
+	f.broadcastLocked()
+	return "ok", nil
+}
+
+// Runs the G-code macros the farm relies on
+func (f *FakeMoonraker) scriptLocked(script string) {
+	switch {
+	case strings.HasPrefix(script, "DISPLAY_NOTIFICATION"):
+		f.display = strings.TrimSpace(strings.TrimPrefix(script, "DISPLAY_NOTIFICATION"))
+		f.operateLocked(f.acknowledgeLocked)
+	case strings.HasPrefix(script, "DISPLAY_DEFAULT"):
+		f.display = ""
+	case script == "M112":
+		f.shutdownLocked("Shutdown due to M112 command")
+	case script == "FIRMWARE_RESTART":
+		f.restartLocked()
+	}
+}
+
+// Has the simulated technician do something after AckDelay
+func (f *FakeMoonraker) operateLocked(action func()) {
+	if !f.AutoOperate {
+		return
+	}
+	time.AfterFunc(f.AckDelay, func() {
+		f.mu.Lock()
+		action()
+		f.mu.Unlock()
+	})
+}
+
+// The technician confirms the printer is ready for the notified print
+func (f *FakeMoonraker) Acknowledge() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acknowledgeLocked()
+}
+
+func (f *FakeMoonraker) acknowledgeLocked() {
+	f.idleFlag = false
+	f.gcodeResponseLocked("// IdleFlag:0.0")
+}
+
+// The technician takes the finished print off the bed
+func (f *FakeMoonraker) ClearBed() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clearBedLocked()
+}
+
+func (f *FakeMoonraker) clearBedLocked() {
+	f.idleFlag = true
+	f.gcodeResponseLocked("// IdleFlag:1.0")
+}
+
+// Puts Klipper in its error state, as a shutdown mid-print would
+func (f *FakeMoonraker) Fail(message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shutdownLocked(message)
+	f.broadcastLocked()
+}
+
+// Klipper stops everything and waits for FIRMWARE_RESTART. The simulated
+// technician restarts it and clears the bed
+func (f *FakeMoonraker) shutdownLocked(message string) {
+	f.state = "error"
+	f.message = message
+	f.operateLocked(func() {
+		f.restartLocked()
+		f.clearBedLocked()
+	})
+}
+
+func (f *FakeMoonraker) restartLocked() {
+	if f.state == "error" {
+		f.state = "standby"
+		f.message = ""
+		f.broadcastLocked()
+	}
+}
+
+// The printer's state and file, for tests
+func (f *FakeMoonraker) PrintState() (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state, f.filename
+}
+
+// Moves the current print along every tick until Close
+func (f *FakeMoonraker) run() {
+	ticker := time.NewTicker(fakeTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.done:
+			return
+		}
+		f.mu.Lock()
+		if f.state == "printing" {
+			f.progress += f.Speed * fakeTick.Seconds() / f.duration.Seconds()
+			if f.progress >= 1 {
+				f.progress = 1
+				f.state = "complete"
+				f.operateLocked(f.clearBedLocked)
+			}
+			f.broadcastLocked()
+		}
+		f.mu.Unlock()
+	}
+}
+
+// The current state of the named printer objects
+func (f *FakeMoonraker) objectsLocked(names []string) map[string]interface{} {
+	var hotend, bed float64
+	if f.state == "printing" || f.state == "paused" {
+		hotend, bed = 210, 60
+	}
+	all := map[string]interface{}{
+		"print_stats": map[string]interface{}{
+			"filename":       f.filename,
+			"state":          f.state,
+			"message":        f.message,
+			"print_duration": f.progress * f.duration.Seconds(),
+			"total_duration": f.progress * f.duration.Seconds(),
+		},
+		"virtual_sdcard": map[string]interface{}{
+			"progress":  f.progress,
+			"is_active": f.state == "printing",
+		},
+		"webhooks":       f.webhooksLocked(),
+		"extruder":       map[string]interface{}{"temperature": hotend, "target": hotend},
+		"heater_bed":     map[string]interface{}{"temperature": bed, "target": bed},
+		"display_status": map[string]interface{}{"progress": f.progress, "message": f.display},
+	}
+	objects := make(map[string]interface{})
+	for _, name := range names {
+		if object, ok := all[name]; ok {
+			objects[name] = object
+		}
+	}
+	return objects
+}
+
+func (f *FakeMoonraker) webhooksLocked() map[string]interface{} {
+	if f.state == "error" {
+		return map[string]interface{}{"state": "shutdown", "state_message": f.message}
+	}
+	return map[string]interface{}{"state": "ready", "state_message": "Printer is ready"}
+}
+
+// Sends each client the objects it subscribed to. Sending them whole is
+// a delta that happens to change everything
+func (f *FakeMoonraker) broadcastLocked() {
+	for c := range f.clients {
+		if len(c.objects) == 0 {
+			continue
+		}
+		c.send(Jsonrpc{
+			Jsonrpc: "2.0",
+			Method:  "notify_status_update",
+			Params:  []interface{}{f.objectsLocked(c.objects), eventtime()},
+		})
+	}
+}
+
+func (f *FakeMoonraker) gcodeResponseLocked(response string) {
+	for c := range f.clients {
+		c.send(Jsonrpc{Jsonrpc: "2.0", Method: "notify_gcode_response", Params: []interface{}{response}})
+	}
+}
+
+// Queues a message, called with f.mu held. A client that falls too far
+// behind is disconnected, as Moonraker would drop a stalled socket
+func (c *fakeClient) send(data Jsonrpc) {
+	select {
+	case c.out <- data:
+	default:
+		c.ws.Close()
+	}
+}
+
+func eventtime() float64 {
+	return float64(time.Now().UnixNano()) / 1e9
+}
+
+// farm-node simulate: runs fake printers on consecutive ports until interrupted,
+// and prints the [printers.N] blocks that point the farm at them
+func runSimulate(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	count := flags.Int("n", 3, "number of printers")
+	host := flags.String("host", "127.0.0.1", "address to listen on")
+	port := flags.Int("port", 7125, "port of the first printer")
+	speed := flags.Float64("speed", 60, "how many times faster than real time prints run")
+	ack := flags.Duration("ack", 5*time.Second, "how long the simulated technician takes to respond")
+	flags.Parse(args)
+
+	var config strings.Builder
+	var fakes []*FakeMoonraker
+	for i := 0; i < *count; i++ {
+		f := NewFakeMoonraker()
+		fakes = append(fakes, f)
+		f.Speed = *speed
+		f.AckDelay = *ack
+		addr, err := f.Listen(net.JoinHostPort(*host, strconv.Itoa(*port+i)))
+		if err != nil {
+			return err
+		}
+		log.Printf("simulated printer %d on %s", i, addr)
+		fmt.Fprintf(&config, "[printers.%d]\nhost = %q\nport = \"%d\"\n\n", i, *host, *port+i)
+	}
+	fmt.Print(config.String())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	for _, f := range fakes {
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// Runs a job through the Moonraker driver against a simulated printer:
+// uploaded, acknowledged, printed to completion and cleared
+func TestMoonrakerAgainstFakePrinter(t *testing.T) {
+	if estimated := estimatedPrintTime([]byte("; estimated printing time (normal mode) = 1h 2m 3s\n")); estimated != time.Hour+2*time.Minute+3*time.Second {
+		t.Errorf("estimated print time = %v, want 1h2m3s", estimated)
+	}
+
+	path := filepath.Join(t.TempDir(), "testing.gcode")
+	if err := os.WriteFile(path, []byte(";TIME:2\nG28\nG1 X10 Y10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gcodeSource = &LocalSource{PathTemplate: template.Must(template.New("path").Parse(path))}
+	t.Cleanup(func() { gcodeSource = nil })
+
+	fake := NewFakeMoonraker()
+	fake.Speed = 10
+	if _, err := fake.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fake.Close)
+	driver := NewMoonraker(fake.HostPort())
+	t.Cleanup(driver.Close)
+
+	store := NewMemoryStore()
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	startFarm(t, store, driver)
+
+	waitFor(t, "fake printer to start", func() bool {
+		state, filename := fake.PrintState()
+		return state == "printing" && filename == "testing.gcode"
+	})
+	// The job is archived as soon as its file succeeds
+	waitFor(t, "job to be archived", func() bool {
+		job, ok := store.ArchivedJob("job-1")
+		return ok && job.GcodeFiles[0].Status == GcodePrintSuccess
+	})
+	printer := farm.Printers()[0]
+	waitFor(t, "printer to be released", func() bool { return printer.GetStatus() == Standby })
+}
+
+// Edits the printer list under a running farm: a printer taken out of the
+// config finishes its print before it goes, a new one is connected, and
+// one given a new port is reconnected there
+func TestReloadPrinters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testing.gcode")
+	if err := os.WriteFile(path, []byte(";TIME:20\nG28\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gcodeSource = &LocalSource{PathTemplate: template.Must(template.New("path").Parse(path))}
+	t.Cleanup(func() { gcodeSource = nil })
+
+	fakes := make([]*FakeMoonraker, 3)
+	for i := range fakes {
+		fakes[i] = NewFakeMoonraker()
+		fakes[i].Speed = 10
+		if _, err := fakes[i].Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(fakes[i].Close)
+	}
+	store := NewMemoryStore()
+	reload := func(id string, f *FakeMoonraker) {
+		host, port := f.HostPort()
+		reloadPrinters(context.Background(), store, []PrinterConfig{{Id: id, Host: host, Port: port}})
+	}
+
+	startFarm(t, store)
+	t.Cleanup(func() {
+		for _, p := range farm.Printers() {
+			p.Close()
+		}
+	})
+	// Waits for a printer rather than failing for want of one
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	waitFor(t, "file to be queued", func() bool { return farm.QueueLen() == 1 })
+	reload("0", fakes[0])
+	waitFor(t, "print to start", func() bool {
+		state, _ := fakes[0].PrintState()
+		return state == "printing"
+	})
+	first := farm.Printers()[0]
+	store.PutJob(jobFromFalseDocument(t, "job-2", falseJobDocument()))
+	waitFor(t, "second file to be queued", func() bool { return farm.QueueLen() == 1 })
+
+	// The same machine, reached at another address
+	other := httptest.NewServer(fakes[0])
+	t.Cleanup(other.Close)
+	host, port, _ := net.SplitHostPort(other.Listener.Addr().String())
+	reloadPrinters(context.Background(), store, []PrinterConfig{{Id: "0", Host: host, Port: port}})
+	printer0 := farm.Printers()[0]
+	if printer0 == first || printer0.Name() != host+":"+port {
+		t.Fatal("printer with a new address not replaced")
+	}
+	waitFor(t, "old connection to close", func() bool { return !first.Online() })
+	waitFor(t, "print to be adopted", func() bool {
+		active := farm.ActiveForJob("job-1")
+		return len(active) == 1 && active[0].Printer == printer0
+	})
+	if file, _ := storedFile(store, "job-1", 0); file.Status != GcodePrinting {
+		t.Errorf("moved printer's file has status %d, want GcodePrinting", file.Status)
+	}
+	// Still busy, so the file behind it waits
+	if file, _ := storedFile(store, "job-2", 0); file.Status != GcodeIdle || file.Attempts != 0 || farm.QueueLen() != 1 {
+		t.Errorf("queued file has status %d after %d attempts while the moved printer is busy", file.Status, file.Attempts)
+	}
+	if status := printer0.GetStatus(); status != Printing {
+		t.Errorf("moved printer status = %d, want Printing", status)
+	}
+
+	reload("1", fakes[1])
+	if !printer0.Draining() {
+		t.Error("removed printer is not draining")
+	}
+	if state, _ := fakes[0].PrintState(); state != "printing" {
+		t.Errorf("removed printer state = %s, want printing", state)
+	}
+	waitFor(t, "new printer to connect", func() bool {
+		printers := farm.Printers()
+		return len(printers) == 2 && printers[1].Id == "1" && printers[1].Online()
+	})
+	printer1 := farm.Printers()[1]
+
+	reload("1", fakes[2])
+	host, port = fakes[2].HostPort()
+	waitFor(t, "moved printer to reconnect", func() bool {
+		printers := farm.Printers()
+		return len(printers) == 2 && printers[1] != printer1 &&
+			printers[1].Name() == host+":"+port && printers[1].Online()
+	})
+	if printer1.Online() {
+		t.Error("old connection of the moved printer left open")
+	}
+
+	waitFor(t, "job to be archived", func() bool {
+		job, ok := store.ArchivedJob("job-1")
+		return ok && job.GcodeFiles[0].Status == GcodePrintSuccess && job.GcodeFiles[0].PrinterId == "0"
+	})
+	// Moved off the machine printing it, so printed again on the new one
+	waitFor(t, "second job to be archived", func() bool {
+		job, ok := store.ArchivedJob("job-2")
+		return ok && job.GcodeFiles[0].Status == GcodePrintSuccess && job.GcodeFiles[0].PrinterId == "1"
+	})
+	waitFor(t, "removed printer to go", func() bool {
+		return len(farm.Printers()) == 1 && !printer0.Online()
+	})
+}
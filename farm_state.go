@@ -0,0 +1,297 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// FarmState owns the jobs, G-code queue and printers shared between the
+// snapshot listener, the scheduler and Firestore maintenance. Everything
+// goes through its accessors, which hand out copies, so no caller ever
+// touches the collections without holding the lock
+type FarmState struct {
+	mu       sync.Mutex
+	jobs     []Job
+	queue    *GcodeQueue
+	printers []*Print
+
+	// Files taken off the queue and handed to a printer, by Key
+	active map[string]activeGcode
+	// When a config reload last changed the printers, zero if none has
+	printersChangedAt time.Time
+
+	queueChanged Signal
+	jobsChanged  Signal
+}
+
+// The farm-wide state store
+var farm = NewFarmState()
+
+func NewFarmState() *FarmState {
+	return &FarmState{
+		queue:  NewGcodeQueue(QueueOrder{Mode: "priority"}),
+		active: make(map[string]activeGcode),
+	}
+}
+
+// A file a printer is handling
+type activeGcode struct {
+	File    GcodeFile
+	Printer *Print
+}
+
+// Changes how the G-code queue is ordered
+func (f *FarmState) SetQueueOrder(order QueueOrder) {
+	f.mu.Lock()
+	f.queue.SetOrder(order)
+	f.mu.Unlock()
+	f.queueChanged.Notify()
+}
+
+// Returns a copy of all jobs
+func (f *FarmState) Jobs() []Job {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Job(nil), f.jobs...)
+}
+
+func (f *FarmState) Job(jobId string) (Job, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.jobs {
+		if f.jobs[i].JobId == jobId {
+			return f.jobs[i], true
+		}
+	}
+	return Job{}, false
+}
+
+// Adds a job, or replaces the job with the same JobId
+func (f *FarmState) PutJob(job Job) {
+	defer f.jobsChanged.Notify()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.jobs {
+		if f.jobs[i].JobId == job.JobId {
+			f.jobs[i] = job
+			return
+		}
+	}
+	f.jobs = append(f.jobs, job)
+}
+
+func (f *FarmState) RemoveJob(jobId string) {
+	defer f.jobsChanged.Notify()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.jobs {
+		if f.jobs[i].JobId == jobId {
+			f.jobs = append(f.jobs[:i:i], f.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Adds files to the G-code queue
+func (f *FarmState) PushGcode(files ...GcodeFile) {
+	now := time.Now()
+	f.mu.Lock()
+	for _, gcode := range files {
+		if gcode.EnqueuedAt.IsZero() {
+			gcode.EnqueuedAt = now
+		}
+		f.queue.Add(gcode)
+	}
+	f.mu.Unlock()
+	f.queueChanged.Notify()
+}
+
+// Takes a file out of the G-code queue. Reports false if it wasn't queued,
+// for instance because another pass already took it
+func (f *FarmState) RemoveGcode(gcode GcodeFile) bool {
+	f.mu.Lock()
+	removed := f.queue.Remove(gcode.Key())
+	f.mu.Unlock()
+	if removed {
+		f.queueChanged.Notify()
+	}
+	return removed
+}
+
+// Queues a file that is waiting for a printer. A file already queued is
+// updated in place; one a printer is handling is left alone
+func (f *FarmState) OfferGcode(gcode GcodeFile) {
+	f.mu.Lock()
+	if _, ok := f.active[gcode.Key()]; ok {
+		f.mu.Unlock()
+		return
+	}
+	if !f.queue.Update(gcode) {
+		if gcode.EnqueuedAt.IsZero() {
+			gcode.EnqueuedAt = time.Now()
+		}
+		f.queue.Add(gcode)
+	}
+	f.mu.Unlock()
+	f.queueChanged.Notify()
+}
+
+// Takes a file off the queue for a printer. Reports false if it wasn't
+// queued, for instance because it was withdrawn in the meantime
+func (f *FarmState) ClaimGcode(gcode GcodeFile, p *Print) bool {
+	f.mu.Lock()
+	claimed := f.queue.Remove(gcode.Key())
+	if claimed {
+		f.active[gcode.Key()] = activeGcode{File: gcode, Printer: p}
+	}
+	f.mu.Unlock()
+	if claimed {
+		f.queueChanged.Notify()
+	}
+	return claimed
+}
+
+// Records a file as handled by a printer that was already running it
+func (f *FarmState) AdoptGcode(gcode GcodeFile, p *Print) {
+	f.mu.Lock()
+	f.queue.Remove(gcode.Key())
+	f.active[gcode.Key()] = activeGcode{File: gcode, Printer: p}
+	f.mu.Unlock()
+}
+
+// Forgets a claimed file once its printer is done with it. A file that has
+// since gone to another printer is left with that one
+func (f *FarmState) ReleaseGcode(gcode GcodeFile, p *Print) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if a, ok := f.active[gcode.Key()]; ok && a.Printer == p {
+		delete(f.active, gcode.Key())
+	}
+}
+
+// Returns the queued files belonging to a job
+func (f *FarmState) QueuedForJob(jobId string) []GcodeFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var files []GcodeFile
+	for _, gcode := range f.queue.files {
+		if gcode.JobId == jobId {
+			files = append(files, gcode)
+		}
+	}
+	return files
+}
+
+// Returns the files of a job that printers are handling
+func (f *FarmState) ActiveForJob(jobId string) []activeGcode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var files []activeGcode
+	for _, a := range f.active {
+		if a.File.JobId == jobId {
+			files = append(files, a)
+		}
+	}
+	return files
+}
+
+// Returns a copy of the G-code queue in print order
+func (f *FarmState) Queue() []GcodeFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queue.Sorted()
+}
+
+func (f *FarmState) QueueLen() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queue.Len()
+}
+
+// Returns a channel that is closed the next time the queue changes
+func (f *FarmState) QueueChanged() <-chan struct{} {
+	return f.queueChanged.Wait()
+}
+
+// Returns a channel that is closed the next time a job changes
+func (f *FarmState) JobsChanged() <-chan struct{} {
+	return f.jobsChanged.Wait()
+}
+
+func (f *FarmState) AddPrinter(p *Print) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.printers = append(f.printers, p)
+}
+
+// Takes a printer out of the farm, once it is done with its files
+func (f *FarmState) RemovePrinter(p *Print) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.printers {
+		if f.printers[i] == p {
+			f.printers = append(f.printers[:i:i], f.printers[i+1:]...)
+			return
+		}
+	}
+}
+
+// How long the printers have to stay as they are after a config reload
+// before queued files are failed for fitting none of them. A config file
+// saved in several writes then doesn't fail them part way
+const printersSettleTime = 5 * time.Second
+
+// Records that a config reload changed the printers
+func (f *FarmState) MarkPrintersChanged() {
+	f.mu.Lock()
+	f.printersChangedAt = time.Now()
+	f.mu.Unlock()
+}
+
+// How long until the printers count as settled after a reload, 0 once
+// they do
+func (f *FarmState) PrintersSettling() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.printersChangedAt.IsZero() {
+		return 0
+	}
+	if left := printersSettleTime - time.Since(f.printersChangedAt); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// Puts a printer in the place of another in one step, so the farm is never
+// without either. Reports false if old is no longer in the farm
+func (f *FarmState) ReplacePrinter(old *Print, p *Print) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.printers {
+		if f.printers[i] == old {
+			f.printers[i] = p
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the files a printer is handling
+func (f *FarmState) ActiveForPrinter(p *Print) []GcodeFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var files []GcodeFile
+	for _, a := range f.active {
+		if a.Printer == p {
+			files = append(files, a.File)
+		}
+	}
+	return files
+}
+
+// Returns a copy of the printer list
+func (f *FarmState) Printers() []*Print {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*Print(nil), f.printers...)
+}
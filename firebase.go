@@ -3,31 +3,46 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"os"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	firebase "firebase.google.com/go"
 	"github.com/spf13/viper"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// jobsSnapshot keeps our local global jobs in sync with firebase
-func jobsSnapshot(ctx context.Context, client *firestore.Client) {
+// FirestoreStore keeps jobs in the jobs and completed_jobs collections of a
+// Firestore database
+type FirestoreStore struct {
+	client *firestore.Client
+}
+
+func NewFirestoreStore(client *firestore.Client) *FirestoreStore {
+	return &FirestoreStore{client: client}
+}
+
+func (s *FirestoreStore) Close() error {
+	return s.client.Close()
+}
+
+// Follows the jobs collection through snapshots, the first of which holds
+// every job as added
+func (s *FirestoreStore) WatchJobs(ctx context.Context, handle func(JobChange)) error {
 
 	// Get all our order documents
-	snapIter := client.Collection("jobs").Snapshots(ctx)
+	snapIter := s.client.Collection("jobs").Snapshots(ctx)
 	defer snapIter.Stop()
 
 	// Block our thread to never return
 	for {
-		// Get our current array
-		jobDocs := jobs
-
 		// Prepare our snapshot changes
 		snap, err := snapIter.Next()
 		if err != nil {
-			fmt.Println(err)
+			return err
 		}
 
 		// Grab what document changes have occurred
@@ -35,164 +50,259 @@ func jobsSnapshot(ctx context.Context, client *firestore.Client) {
 		for index := 0; index < len(docChanges); index++ {
 			// Get the current document change
 			docChange := docChanges[index]
-			var orderDocument Job
-
-			// Cast our object into something we can work with
-			err = docChange.Doc.DataTo(&orderDocument)
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			// Give the Job its document ID from the database
-			orderDocument.JobId = docChange.Doc.Ref.ID
-			// Give each of the Gcode files the ID of its Job
-			// Give each of the Gcode files their index
-			for i := range orderDocument.GcodeFiles {
-				orderDocument.GcodeFiles[i].JobId = docChange.Doc.Ref.ID
-				orderDocument.GcodeFiles[i].FileIndex = i
-			}
-
-			// Check each possible case of the changes that could occur
-			switch change := docChange.Kind; change {
+			change := JobChange{Job: jobFromDocument(docChange.Doc)}
+			switch docChange.Kind {
 			case firestore.DocumentAdded:
-				// Document has been added to our array
-				fmt.Println("Job Document has been added")
-				// Append our current document in our array
-				jobDocs = append(jobDocs, orderDocument)
-				// Do something when document is added?
-
-				// fmt.Println(orderDocument)
-
-				// Put all the Gcode files into gcodeQueue
-				for i := range orderDocument.GcodeFiles {
-					gcodeQueue = append(gcodeQueue, orderDocument.GcodeFiles[i])
-				}
+				change.Kind = JobAdded
 			case firestore.DocumentModified:
-				// Document has been modified
-				fmt.Println("Job Document has been modified")
-				// Modify that element in our local array, orderDocument = document that was just modified
-				jobDocs[docChange.NewIndex] = orderDocument
-				fmt.Println(orderDocument)
-				// Do something when document is modified?
+				change.Kind = JobModified
 			case firestore.DocumentRemoved:
-				// Document has been removed
-				fmt.Println("Job Document has been removed")
-				// Remove the document from our local array
-				jobDocs = append(jobDocs[:docChange.OldIndex], jobDocs[docChange.OldIndex+1:]...)
-				// Do something when document is removed?
-			default:
-				fmt.Println("Default Job Document changes called")
+				change.Kind = JobRemoved
 			}
+			handle(change)
 		}
-		// Save to our global variable
-		jobs = jobDocs
 	}
 }
 
-// FirebaseInstance obtains the client and ctx when needed
-func FirebaseInstance() (*firestore.Client, context.Context, error) {
+// Casts a job document into a Job, filling in what the files need to know
+// about the job they belong to
+func jobFromDocument(doc *firestore.DocumentSnapshot) Job {
+	var orderDocument Job
+
+	// Cast our object into something we can work with
+	err := doc.DataTo(&orderDocument)
+	if err != nil {
+		jobLog(doc.Ref.ID).Error(err)
+	}
+
+	// Give the Job its document ID from the database
+	orderDocument.JobId = doc.Ref.ID
+	orderDocument.fillFiles()
+	return orderDocument
+}
+
+// Reads every document in the jobs collection once
+func (s *FirestoreStore) ListJobs(ctx context.Context) ([]Job, error) {
+	docs, err := s.client.Collection("jobs").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(docs))
+	for _, doc := range docs {
+		jobs = append(jobs, jobFromDocument(doc))
+	}
+	return jobs, nil
+}
+
+// FirebaseInstance obtains the client when needed. Snapshot listeners and
+// calls take their own contexts; ctx only covers setting the client up
+func FirebaseInstance(ctx context.Context) (*firestore.Client, error) {
 
 	// Get static variables for setting up the firestore
 	var opt = option.WithCredentialsFile(viper.GetString("database.path"))
 	var config = &firebase.Config{ProjectID: viper.GetString("database.projectId")}
 
+	// The client connects to the emulator by itself when
+	// FIRESTORE_EMULATOR_HOST is set, which takes no credentials
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") != "" || viper.GetBool("database.skip_credentials") {
+		logger.Info("connecting to Firestore without credentials")
+		opt = option.WithoutAuthentication()
+	}
+
 	// Setup the FireStore data
-	ctx := context.Background()
 	app, err := firebase.NewApp(ctx, config, opt)
 	if err != nil {
-		log.Fatalf("error initializing app: %v\n", err)
-	}
-	client, err := app.Firestore(ctx)
-	if err != nil {
-		return nil, ctx, err
+		return nil, fmt.Errorf("error initializing app: %w", err)
 	}
-
-	return client, ctx, nil
+	return app.Firestore(ctx)
 }
 
-// Update status for a single Gcode file in database
-// Copies whole doc, modifes, then replaces
-func UpdateFileStatus(gcode GcodeFile, ctx context.Context, client *firestore.Client) {
+// Changes the file in place inside a transaction, so writes for other files
+// of the same job can't be lost. Fields farm-node doesn't know about are
+// left as they are
+func (s *FirestoreStore) UpdateFileStatus(ctx context.Context, gcode GcodeFile) error {
 	jobId := gcode.JobId
 	fileIndex := gcode.FileIndex
 
-	job := client.Doc(fmt.Sprintf("jobs/%s", jobId))
+	job := s.client.Doc(fmt.Sprintf("jobs/%s", jobId))
 
-	var jobDocument Job
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docsnap, err := tx.Get(job)
+		if err != nil {
+			// The job may have been removed while the file was printing
+			return err
+		}
+		files, _ := docsnap.Data()["gcode"].([]interface{})
+		var file map[string]interface{}
+		if fileIndex < len(files) {
+			file, _ = files[fileIndex].(map[string]interface{})
+		}
+		filename, _ := file["filename"].(string)
+		current, _ := file["status"].(int64)
+		if err := checkFileUpdate(gcode, file != nil, filename, int(current)); err != nil {
+			return err
+		}
 
-	docsnap, err := job.Get(ctx)
-	if err != nil {
-		fmt.Println(err)
-	}
+		// Work out the new status the way the other stores do, then write
+		// its fields back into the file, leaving the rest as it is
+		var stored Job
+		if err := docsnap.DataTo(&stored); err != nil {
+			return err
+		}
+		updated := stored.GcodeFiles[fileIndex]
+		applyFileStatus(&updated, gcode, time.Now())
+		setFileStatusFields(file, updated)
+		return tx.Update(job, []firestore.Update{{Path: "gcode", Value: files}})
+	})
+}
 
-	err = docsnap.DataTo(&jobDocument)
-	if err != nil {
-		fmt.Println(err)
+// Copies the fields applyFileStatus sets onto a file of a job document.
+// Unset times and printer are left out of the document
+func setFileStatusFields(file map[string]interface{}, gcode GcodeFile) {
+	file["status"] = gcode.Status
+	file["message"] = gcode.Message
+	file["attempts"] = gcode.Attempts
+	file["failed_on"] = gcode.FailedOn
+	delete(file, "started_at")
+	delete(file, "finished_at")
+	delete(file, "printer_id")
+	if !gcode.StartedAt.IsZero() {
+		file["started_at"] = gcode.StartedAt
+	}
+	if !gcode.FinishedAt.IsZero() {
+		file["finished_at"] = gcode.FinishedAt
+	}
+	if gcode.PrinterId != "" {
+		file["printer_id"] = gcode.PrinterId
 	}
+}
 
-	// fmt.Println(jobDocument)
+// Sets enqueued_at on the file unless it already has one
+func (s *FirestoreStore) RecordEnqueued(ctx context.Context, gcode GcodeFile) error {
+	job := s.client.Doc(fmt.Sprintf("jobs/%s", gcode.JobId))
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docsnap, err := tx.Get(job)
+		if err != nil {
+			return err
+		}
+		files, _ := docsnap.Data()["gcode"].([]interface{})
+		var file map[string]interface{}
+		if gcode.FileIndex < len(files) {
+			file, _ = files[gcode.FileIndex].(map[string]interface{})
+		}
+		filename, _ := file["filename"].(string)
+		current, _ := file["status"].(int64)
+		if err := checkFileUpdate(gcode, file != nil, filename, int(current)); err != nil {
+			return err
+		}
+		if at, ok := file["enqueued_at"].(time.Time); ok && !at.IsZero() {
+			return nil
+		}
+		file["enqueued_at"] = gcode.EnqueuedAt
+		return tx.Update(job, []firestore.Update{{Path: "gcode", Value: files}})
+	})
+}
 
-	// Modify the job doc
-	jobDocument.JobId = jobId
-	jobDocument.GcodeFiles[fileIndex].FileIndex = fileIndex
-	jobDocument.GcodeFiles[fileIndex].Status = gcode.Status
-	jobDocument.GcodeFiles[fileIndex].JobId = jobId
+// Writes a queued file's place in line to queue.<file index> on its job
+// document. Only that field is touched, so no read is needed
+func (s *FirestoreStore) UpdateQueueProjection(ctx context.Context, proj QueueProjection) error {
+	value := map[string]interface{}{"position": proj.Position}
+	if proj.StartsNow {
+		value["starts_now"] = true
+	} else if !proj.ProjectedStart.IsZero() {
+		value["projected_start"] = proj.ProjectedStart
+	}
+	job := s.client.Doc(fmt.Sprintf("jobs/%s", proj.File.JobId))
+	_, err := job.Update(ctx, []firestore.Update{
+		{FieldPath: []string{"queue", strconv.Itoa(proj.File.FileIndex)}, Value: value},
+	})
+	return err
+}
 
-	wr, err := job.Set(ctx, jobDocument)
-	if err != nil {
-		fmt.Println(err)
+// Removes a file's queue entry once it has left the queue
+func (s *FirestoreStore) ClearQueueProjection(ctx context.Context, gcode GcodeFile) error {
+	job := s.client.Doc(fmt.Sprintf("jobs/%s", gcode.JobId))
+	_, err := job.Update(ctx, []firestore.Update{
+		{FieldPath: []string{"queue", strconv.Itoa(gcode.FileIndex)}, Value: firestore.Delete},
+	})
+	// The job is gone along with its queue entries
+	if status.Code(err) == codes.NotFound {
+		return nil
 	}
-	fmt.Println(wr.UpdateTime, "Job ID:", jobId, "File Index:", fileIndex, "Status updated to 1")
+	return err
 }
 
-//-----------------------------------------------------------------------------
-// check local jobs array, scanning for gcode statuses if all gcode statuses
-// are completed, or canceled then update firestore database by removing job
-// document from jobs collection and into completed_jobs collection
-// keep looping
-func maintainFirestore(ctx context.Context, client *firestore.Client) {
-	for range time.Tick(time.Minute * 1) {
-		for i := range jobs {
-			job := jobs[i]
-			jobId := job.JobId
-			fmt.Print(jobId)
-			gcodeFiles := job.GcodeFiles
-			count := 0
-			for j := range gcodeFiles {
-				gcodeFile := gcodeFiles[j]
-				if gcodeFile.Status == GcodePrintSuccess || gcodeFile.Status == GcodeCanceled {
-					count += 1
-				}
-			}
-			// Move job from jobs collection to completed_jobs collection
-			// Grabs job document pertaining to jobId
-			document := client.Doc(fmt.Sprintf("jobs/%s", jobId))
-			var jobDocument Job
-			docsnap, err := document.Get(ctx)
-
-			if err != nil {
-				fmt.Println(err)
-			}
+// Moves a finished job from jobs to completed_jobs in one transaction,
+// checking against the stored document that every file is finished
+func (s *FirestoreStore) ArchiveJob(ctx context.Context, jobId string) error {
+	document := s.client.Doc(fmt.Sprintf("jobs/%s", jobId))
+	// references completed_jobs collection to be copied into
+	newDocument := s.client.Doc(fmt.Sprintf("completed_jobs/%s", jobId))
 
-			err = docsnap.DataTo(&jobDocument)
-			if err != nil {
-				fmt.Println(err)
-			}
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docsnap, err := tx.Get(document)
+		if err != nil {
+			return err
+		}
+		if !jobFinished(jobFromDocument(docsnap)) {
+			return errJobNotFinished
+		}
 
-			//fmt.Println(jobDocument)
-			// references completed_jobs collection to be copied into
-			newDocument := client.Doc(fmt.Sprintf("completed_jobs/%s", jobId))
-			wr, err := newDocument.Set(ctx, jobDocument)
-			if err != nil {
-				fmt.Println(err)
-			}
-			fmt.Println(wr.UpdateTime)
+		jobDocument := docsnap.Data()
+		// Queue positions and controls mean nothing once the job is done
+		delete(jobDocument, "queue")
+		delete(jobDocument, "control")
+		if status, _ := jobDocument["status"].(int64); status != JobCanceled {
+			jobDocument["status"] = JobCompleted
+		}
+		jobDocument["archived_at"] = time.Now()
 
-			// wr, err = document.Delete(ctx)
-			// if err != nil {
-			// 	fmt.Println(err)
-			// }
-			// fmt.Println(wr.UpdateTime)
+		if err := tx.Set(newDocument, jobDocument); err != nil {
+			return err
+		}
+		return tx.Delete(document)
+	})
+}
+
+func (s *FirestoreStore) ClearControl(ctx context.Context, jobId string, control string) error {
+	job := s.client.Doc(fmt.Sprintf("jobs/%s", jobId))
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docsnap, err := tx.Get(job)
+		if err != nil {
+			return err
+		}
+		if current, _ := docsnap.Data()["control"].(string); current != control {
+			return nil
+		}
+		return tx.Update(job, []firestore.Update{{Path: "control", Value: firestore.Delete}})
+	})
+}
+
+// Deletes archived jobs that were archived before cutoff
+func (s *FirestoreStore) PruneArchive(ctx context.Context, cutoff time.Time) error {
+	// Firestore batches take up to 500 writes
+	const batchSize = 500
+	for {
+		docs, err := s.client.Collection("completed_jobs").
+			Where("archived_at", "<", cutoff).
+			Limit(batchSize).
+			Documents(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		batch := s.client.Batch()
+		for _, doc := range docs {
+			batch.Delete(doc.Ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+		logger.Infof("deleted %d archived jobs", len(docs))
+		if len(docs) < batchSize {
+			return nil
 		}
 	}
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"cloud.google.com/go/storage"
+	"github.com/spf13/viper"
+	"google.golang.org/api/option"
+)
+
+var ErrGcodeNotFound = errors.New("gcode file not found")
+
+// GcodeSource is where the G-code for a GcodeFile is read from before it is
+// uploaded to a printer. Open also returns the size in bytes, or -1 when
+// the source can't tell in advance
+type GcodeSource interface {
+	Open(ctx context.Context, GF GcodeFile) (io.ReadCloser, int64, error)
+}
+
+// The source configured under [gcode_source], set up by main
+var gcodeSource GcodeSource
+
+// Opens a file's G-code. A file carrying its own url is fetched from there;
+// anything else comes from the configured source
+func openGcode(ctx context.Context, GF GcodeFile) (io.ReadCloser, int64, error) {
+	if GF.Url != "" {
+		return (&HTTPSource{}).Open(ctx, GF)
+	}
+	if gcodeSource == nil {
+		return nil, 0, fmt.Errorf("no gcode_source configured for %s", GF.Filename)
+	}
+	return gcodeSource.Open(ctx, GF)
+}
+
+// Builds the source selected by gcode_source.type
+func newGcodeSource(ctx context.Context) (GcodeSource, error) {
+	pathTemplate, err := template.New("path").Parse(viper.GetString("gcode_source.path"))
+	if err != nil {
+		return nil, fmt.Errorf("gcode_source.path: %w", err)
+	}
+
+	switch kind := viper.GetString("gcode_source.type"); kind {
+	case "", "local":
+		return &LocalSource{PathTemplate: pathTemplate}, nil
+	case "http":
+		return &HTTPSource{BaseURL: viper.GetString("gcode_source.base_url")}, nil
+	case "bucket":
+		client, err := storage.NewClient(ctx, option.WithCredentialsFile(viper.GetString("database.path")))
+		if err != nil {
+			return nil, err
+		}
+		bucket := client.Bucket(viper.GetString("gcode_source.bucket"))
+		return &BucketSource{Bucket: bucket, PathTemplate: pathTemplate}, nil
+	default:
+		return nil, fmt.Errorf("gcode_source.type: unknown source %q", kind)
+	}
+}
+
+// Fills in a path template with the fields of the GcodeFile, for example
+// "orders/{{.JobId}}/{{.Filename}}"
+func expandPath(t *template.Template, GF GcodeFile) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, GF); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// LocalSource reads G-code from disk. A file's own path wins over the
+// template
+type LocalSource struct {
+	PathTemplate *template.Template
+}
+
+func (s *LocalSource) Open(ctx context.Context, GF GcodeFile) (io.ReadCloser, int64, error) {
+	path := GF.Path
+	if path == "" {
+		var err error
+		if path, err = expandPath(s.PathTemplate, GF); err != nil {
+			return nil, 0, err
+		}
+	}
+	file, err := os.Open(filepath.FromSlash(path))
+	if os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrGcodeNotFound, path)
+	} else if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// HTTPSource downloads G-code from the file's url, or from the filename
+// under BaseURL
+type HTTPSource struct {
+	BaseURL string
+}
+
+func (s *HTTPSource) Open(ctx context.Context, GF GcodeFile) (io.ReadCloser, int64, error) {
+	url := GF.Url
+	if url == "" {
+		url = strings.TrimSuffix(s.BaseURL, "/") + "/" + GF.Filename
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("%w: %s", ErrGcodeNotFound, url)
+	case res.StatusCode != http.StatusOK:
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+// BucketSource reads G-code from a Firebase Storage / GCS bucket. The
+// object name is the file's path, or the template when it has none
+type BucketSource struct {
+	Bucket       *storage.BucketHandle
+	PathTemplate *template.Template
+}
+
+func (s *BucketSource) Open(ctx context.Context, GF GcodeFile) (io.ReadCloser, int64, error) {
+	name := GF.Path
+	if name == "" {
+		var err error
+		if name, err = expandPath(s.PathTemplate, GF); err != nil {
+			return nil, 0, err
+		}
+	}
+	r, err := s.Bucket.Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrGcodeNotFound, name)
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return r, r.Attrs.Size, nil
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+)
+
+// fakeDriver stands in for a printer. Uploads and starts act at once;
+// the test moves the print along by changing its status
+type fakeDriver struct {
+	driverBase
+	name string
+
+	mu       sync.Mutex
+	status   PrinterStatus
+	uploads  []string
+	canceled bool
+	// Returned by Start instead of starting, when set
+	startErr error
+	// When set, the print errors with it as soon as it is started,
+	// without ever being reported as printing
+	faultOnStart string
+}
+
+func newFakeDriver(name string) *fakeDriver {
+	d := &fakeDriver{driverBase: newDriverBase(), name: name}
+	d.status.IdleFlag = true
+	return d
+}
+
+func (d *fakeDriver) Name() string { return d.name }
+func (d *fakeDriver) Connect()     { d.setConnState(ConnOnline) }
+func (d *fakeDriver) Close()       { d.markClosed() }
+
+func (d *fakeDriver) update(change func(*PrinterStatus)) {
+	d.mu.Lock()
+	change(&d.status)
+	d.mu.Unlock()
+	d.notifyStatusChanged()
+}
+
+func (d *fakeDriver) Upload(ctx context.Context, GF GcodeFile) error {
+	d.mu.Lock()
+	d.uploads = append(d.uploads, GF.Filename)
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *fakeDriver) Start(ctx context.Context, filename string) error {
+	d.mu.Lock()
+	err, fault := d.startErr, d.faultOnStart
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.update(func(s *PrinterStatus) {
+		s.State = Printing
+		s.Filename = filename
+		s.Progress = 0
+		if fault != "" {
+			s.State = E
+			s.Message = fault
+		}
+	})
+	return nil
+}
+
+func (d *fakeDriver) Pause(ctx context.Context) error {
+	d.update(func(s *PrinterStatus) { s.State = Paused })
+	return nil
+}
+
+func (d *fakeDriver) Resume(ctx context.Context) error {
+	d.update(func(s *PrinterStatus) { s.State = Printing })
+	return nil
+}
+
+func (d *fakeDriver) Cancel(ctx context.Context) error {
+	d.mu.Lock()
+	d.canceled = true
+	d.mu.Unlock()
+	d.update(func(s *PrinterStatus) { s.State = Canceled })
+	return nil
+}
+
+func (d *fakeDriver) EmergencyStop(ctx context.Context) error {
+	d.update(func(s *PrinterStatus) {
+		s.State = E
+		s.Message = "Shutdown due to M112 command"
+	})
+	return nil
+}
+
+func (d *fakeDriver) QueryPrint(ctx context.Context) (string, int, error) {
+	status := d.Status()
+	return status.Filename, status.State, nil
+}
+
+func (d *fakeDriver) Status() PrinterStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// The printer display shows the notification until the technician
+// acknowledges it
+func (d *fakeDriver) DisplayMessage(ctx context.Context, GF GcodeFile) error {
+	d.update(func(s *PrinterStatus) { s.IdleFlag = false })
+	return nil
+}
+
+func (d *fakeDriver) DefaultDisplay(ctx context.Context) error { return nil }
+
+func (d *fakeDriver) Uploads() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.uploads...)
+}
+
+// viper isn't safe to change while the farm goroutines read it, so the
+// config the tests share is set up front
+func TestMain(m *testing.M) {
+	viper.Set("archive.interval", "20ms")
+	viper.Set("failure.max_attempts", 2)
+	loadSettings()
+	os.Exit(m.Run())
+}
+
+// Builds a Job the way the snapshot would from a document shaped like
+// addFalseDocumentToJobsCollection writes
+func jobFromFalseDocument(t *testing.T, jobId string, doc map[string]interface{}) Job {
+	t.Helper()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		t.Fatal(err)
+	}
+	job.JobId = jobId
+	job.fillFiles()
+	return job
+}
+
+// Polls until cond holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Starts the farm against store with one printer per driver, the way
+// main does
+func startFarm(t *testing.T, store JobStore, drivers ...Printer) {
+	t.Helper()
+	farm = NewFarmState()
+	for i, d := range drivers {
+		farm.AddPrinter(newPrint(PrinterConfig{Id: strconv.Itoa(i)}, d))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	// The next test replaces farm, so everything using it has to be done
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+		for _, p := range farm.Printers() {
+			p.handlers.Wait()
+		}
+	})
+	if err := reconcileStartup(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range []func(context.Context, JobStore){
+		jobsSnapshot,
+		func(ctx context.Context, store JobStore) { managePrintJobs(ctx, store, &FIFOScheduler{}) },
+		maintainJobStore,
+	} {
+		wg.Add(1)
+		go func(run func(context.Context, JobStore)) {
+			defer wg.Done()
+			run(ctx, store)
+		}(run)
+	}
+}
+
+// Returns the stored file, if its job is still open
+func storedFile(store JobStore, jobId string, index int) (GcodeFile, bool) {
+	jobs, err := store.ListJobs(context.Background())
+	if err != nil {
+		return GcodeFile{}, false
+	}
+	for _, job := range jobs {
+		if job.JobId == jobId && index < len(job.GcodeFiles) {
+			return job.GcodeFiles[index], true
+		}
+	}
+	return GcodeFile{}, false
+}
+
+// Whether the file has the status, in its open job or, for a store that
+// can tell, in the archive a finished job moves to
+func fileHasStatus(store JobStore, jobId string, index int, status int) func() bool {
+	return func() bool {
+		file, ok := storedFile(store, jobId, index)
+		if !ok {
+			if archive, canTell := store.(interface{ ArchivedJob(string) (Job, bool) }); canTell {
+				var job Job
+				job, ok = archive.ArchivedJob(jobId)
+				ok = ok && index < len(job.GcodeFiles)
+				if ok {
+					file = job.GcodeFiles[index]
+				}
+			}
+		}
+		return ok && file.Status == status
+	}
+}
+
+// Takes one job through the farm: queued from the snapshot, assigned to
+// the only printer, printed, cleared and archived
+func runLifecycle(t *testing.T, store JobStore, jobId string, archived func() (Job, bool)) {
+	d := newFakeDriver("printer-0")
+	startFarm(t, store, d)
+
+	waitFor(t, "file to start printing", fileHasStatus(store, jobId, 0, GcodePrinting))
+	waitFor(t, "print to start", func() bool { return d.Status().State == Printing })
+	if uploads := d.Uploads(); len(uploads) != 1 || uploads[0] != "testing.gcode" {
+		t.Fatalf("uploads = %v, want [testing.gcode]", uploads)
+	}
+	file, _ := storedFile(store, jobId, 0)
+	if file.PrinterId != "0" || file.StartedAt.IsZero() {
+		t.Errorf("printing file has printer %q, started %v", file.PrinterId, file.StartedAt)
+	}
+
+	d.update(func(s *PrinterStatus) { s.State = Completed })
+	waitFor(t, "file to succeed", fileHasStatus(store, jobId, 0, GcodePrintSuccess))
+	printer := farm.Printers()[0]
+	if status := printer.GetStatus(); status != Resetting {
+		t.Errorf("printer status = %d until cleared, want Resetting", status)
+	}
+
+	d.update(func(s *PrinterStatus) { s.IdleFlag = true })
+	waitFor(t, "printer to be released", func() bool { return printer.GetStatus() == Standby })
+
+	var job Job
+	waitFor(t, "job to be archived", func() bool {
+		var ok bool
+		job, ok = archived()
+		return ok
+	})
+	if job.Status != JobCompleted {
+		t.Errorf("archived job status = %d, want JobCompleted", job.Status)
+	}
+	if len(job.GcodeFiles) != 1 || job.GcodeFiles[0].FinishedAt.IsZero() {
+		t.Errorf("archived files = %+v, want one finished file", job.GcodeFiles)
+	}
+	if _, open := storedFile(store, jobId, 0); open {
+		t.Error("archived job is still in jobs")
+	}
+}
+
+func TestJobLifecycle(t *testing.T) {
+	store := NewMemoryStore()
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	runLifecycle(t, store, "job-1", func() (Job, bool) { return store.ArchivedJob("job-1") })
+}
+
+func TestCanceledJobIsWithdrawn(t *testing.T) {
+	store := NewMemoryStore()
+	doc := falseJobDocument()
+	files := doc["gcode"].([]interface{})
+	second := map[string]interface{}{}
+	for k, v := range files[0].(map[string]interface{}) {
+		second[k] = v
+	}
+	second["filename"] = "second.gcode"
+	doc["gcode"] = append(files, second)
+	store.PutJob(jobFromFalseDocument(t, "job-1", doc))
+
+	d := newFakeDriver("printer-0")
+	startFarm(t, store, d)
+	waitFor(t, "first file to start printing", func() bool { return d.Status().State == Printing })
+	waitFor(t, "second file to be queued", func() bool { return farm.QueueLen() == 1 })
+
+	job, _ := store.Job("job-1")
+	job.Status = JobCanceled
+	store.PutJob(job)
+
+	waitFor(t, "running file to be canceled", fileHasStatus(store, "job-1", 0, GcodeCanceled))
+	waitFor(t, "queued file to be canceled", fileHasStatus(store, "job-1", 1, GcodeCanceled))
+	if farm.QueueLen() != 0 {
+		t.Errorf("queue has %d files after the job was canceled", farm.QueueLen())
+	}
+
+	d.update(func(s *PrinterStatus) { s.IdleFlag = true })
+	waitFor(t, "job to be archived", func() bool {
+		_, ok := store.ArchivedJob("job-1")
+		return ok
+	})
+	archived, _ := store.ArchivedJob("job-1")
+	if archived.Status != JobCanceled {
+		t.Errorf("archived job status = %d, want JobCanceled", archived.Status)
+	}
+	if uploads := d.Uploads(); len(uploads) != 1 {
+		t.Errorf("uploads = %v, want only the first file", uploads)
+	}
+}
+
+func TestStartupAdoptsRunningPrint(t *testing.T) {
+	store := NewMemoryStore()
+	job := jobFromFalseDocument(t, "job-1", falseJobDocument())
+	job.GcodeFiles[0].Status = GcodePrinting
+	lost := jobFromFalseDocument(t, "job-2", falseJobDocument())
+	lost.GcodeFiles[0].Filename = "lost.gcode"
+	lost.GcodeFiles[0].Status = GcodePrinting
+	store.PutJob(job)
+	store.PutJob(lost)
+
+	// Left running by the previous run
+	d := newFakeDriver("printer-0")
+	d.update(func(s *PrinterStatus) {
+		s.State = Printing
+		s.Filename = "testing.gcode"
+		s.IdleFlag = false
+	})
+	startFarm(t, store, d)
+
+	if status := farm.Printers()[0].GetStatus(); status != Printing {
+		t.Errorf("printer status = %d after adoption, want Printing", status)
+	}
+	// The print nobody has goes back in line; the printer is busy
+	waitFor(t, "lost file to be requeued", fileHasStatus(store, "job-2", 0, GcodeIdle))
+	waitFor(t, "lost file to be queued", func() bool { return farm.QueueLen() == 1 })
+
+	d.update(func(s *PrinterStatus) { s.State = Completed })
+	waitFor(t, "adopted file to succeed", fileHasStatus(store, "job-1", 0, GcodePrintSuccess))
+	if uploads := d.Uploads(); len(uploads) != 0 {
+		t.Errorf("uploads = %v before the printer was cleared, want none", uploads)
+	}
+
+	d.update(func(s *PrinterStatus) { s.IdleFlag = true })
+	waitFor(t, "lost file to be printed", fileHasStatus(store, "job-2", 0, GcodePrinting))
+}
+
+func TestStartupAdoptsFileRecordedOnPrinter(t *testing.T) {
+	store := NewMemoryStore()
+	// The same file printing on two printers, only one of which is back
+	for _, id := range []string{"1", "0"} {
+		job := jobFromFalseDocument(t, "job-"+id, falseJobDocument())
+		job.GcodeFiles[0].Status = GcodePrinting
+		job.GcodeFiles[0].PrinterId = id
+		store.PutJob(job)
+	}
+
+	d := newFakeDriver("printer-0")
+	d.update(func(s *PrinterStatus) {
+		s.State = Printing
+		s.Filename = "testing.gcode"
+		s.IdleFlag = false
+	})
+	startFarm(t, store, d)
+
+	if active := farm.ActiveForJob("job-0"); len(active) != 1 {
+		t.Error("file recorded on the printer wasn't adopted")
+	}
+	waitFor(t, "other printer's file to be requeued", fileHasStatus(store, "job-1", 0, GcodeIdle))
+}
+
+// Sets a control command on the job document, the way the storefront would
+func controlJobDocument(t *testing.T, store *MemoryStore, jobId string, control string) {
+	t.Helper()
+	job, ok := store.Job(jobId)
+	if !ok {
+		t.Fatalf("job %s not found", jobId)
+	}
+	job.Control = control
+	store.PutJob(job)
+}
+
+func controlCleared(store *MemoryStore, jobId string) func() bool {
+	return func() bool {
+		job, ok := store.Job(jobId)
+		return ok && job.Control == ""
+	}
+}
+
+func TestJobControls(t *testing.T) {
+	store := NewMemoryStore()
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	d := newFakeDriver("printer-0")
+	startFarm(t, store, d)
+	waitFor(t, "file to start printing", fileHasStatus(store, "job-1", 0, GcodePrinting))
+	waitFor(t, "print to start", func() bool { return d.Status().State == Printing })
+
+	controlJobDocument(t, store, "job-1", ControlPause)
+	waitFor(t, "file to be paused", fileHasStatus(store, "job-1", 0, GcodePaused))
+	waitFor(t, "pause to be cleared", controlCleared(store, "job-1"))
+	if status := farm.Printers()[0].GetStatus(); status != Paused {
+		t.Errorf("printer status = %d, want Paused", status)
+	}
+
+	controlJobDocument(t, store, "job-1", ControlResume)
+	waitFor(t, "file to resume", fileHasStatus(store, "job-1", 0, GcodePrinting))
+	waitFor(t, "resume to be cleared", controlCleared(store, "job-1"))
+
+	controlJobDocument(t, store, "job-1", ControlEmergencyStop)
+	// A failed file finishes the job, which is archived right away
+	var job Job
+	waitFor(t, "failed job to be archived", func() bool {
+		var ok bool
+		job, ok = store.ArchivedJob("job-1")
+		return ok
+	})
+	if file := job.GcodeFiles[0]; file.Status != GcodeError || file.Message != "Shutdown due to M112 command" {
+		t.Errorf("failed file has status %d, message %q", file.Status, file.Message)
+	}
+	printer := farm.Printers()[0]
+	if status := printer.GetStatus(); status != Maintenance {
+		t.Errorf("printer status = %d after the failure, want Maintenance", status)
+	}
+	// Clearing the bed isn't enough while Klipper is shut down
+	d.update(func(s *PrinterStatus) { s.IdleFlag = true })
+	time.Sleep(20 * time.Millisecond)
+	if status := printer.GetStatus(); status != Maintenance {
+		t.Errorf("printer status = %d before Klipper restarted, want Maintenance", status)
+	}
+	d.update(func(s *PrinterStatus) { s.State = Standby })
+	waitFor(t, "printer to be released", func() bool { return printer.GetStatus() == Standby })
+}
+
+func TestFailedFileIsRetriedOnAnotherPrinter(t *testing.T) {
+	store := NewMemoryStore()
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	failing, other := newFakeDriver("printer-0"), newFakeDriver("printer-1")
+	startFarm(t, store, failing, other)
+	waitFor(t, "first attempt to start", func() bool { return failing.Status().State == Printing })
+	first, _ := storedFile(store, "job-1", 0)
+	if first.EnqueuedAt.IsZero() {
+		t.Error("enqueue time not recorded")
+	}
+
+	failing.update(func(s *PrinterStatus) {
+		s.State = E
+		s.Message = "Heater extruder not heating at expected rate"
+		s.StateMessage = "Lost communication with MCU 'mcu'"
+	})
+	waitFor(t, "second attempt to start", func() bool { return other.Status().State == Printing })
+	file, _ := storedFile(store, "job-1", 0)
+	if file.Attempts != 1 || len(file.FailedOn) != 1 || file.FailedOn[0] != "0" {
+		t.Errorf("retried file has attempts %d, failed on %v", file.Attempts, file.FailedOn)
+	}
+	if !file.EnqueuedAt.Equal(first.EnqueuedAt) {
+		t.Errorf("retried file enqueued at %v, first queued at %v", file.EnqueuedAt, first.EnqueuedAt)
+	}
+
+	printer := farm.Printers()[0]
+	if reason := printer.MaintenanceReason(); !strings.Contains(reason, "Heater extruder") || !strings.Contains(reason, "Lost communication") {
+		t.Errorf("maintenance reason = %q", reason)
+	}
+	if err := farm.Printers()[1].Acknowledge(); err == nil {
+		t.Error("acknowledged a printer that isn't in maintenance")
+	}
+	if err := printer.Acknowledge(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "failed printer to be released", func() bool { return printer.GetStatus() == Standby })
+
+	other.update(func(s *PrinterStatus) { s.State = Completed })
+	other.update(func(s *PrinterStatus) { s.IdleFlag = true })
+	waitFor(t, "job to be archived", func() bool {
+		job, ok := store.ArchivedJob("job-1")
+		return ok && job.GcodeFiles[0].Status == GcodePrintSuccess
+	})
+}
+
+func TestPrintFailingBeforeSeenPrinting(t *testing.T) {
+	store := NewMemoryStore()
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	d := newFakeDriver("printer-0")
+	d.faultOnStart = "Heater extruder not heating at expected rate"
+	startFarm(t, store, d)
+
+	waitFor(t, "file to fail", fileHasStatus(store, "job-1", 0, GcodeError))
+	printer := farm.Printers()[0]
+	waitFor(t, "printer to be held", func() bool { return printer.GetStatus() == Maintenance })
+	if reason := printer.MaintenanceReason(); !strings.Contains(reason, "Heater extruder") {
+		t.Errorf("maintenance reason = %q", reason)
+	}
+}
+
+func TestRejectedStartIsRequeuedWithoutAttempt(t *testing.T) {
+	store := NewMemoryStore()
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	busy, other := newFakeDriver("printer-0"), newFakeDriver("printer-1")
+	busy.startErr = errors.New("Printer busy")
+	errored := testutil.ToFloat64(printsFinished.WithLabelValues("0", "PLA", "errored"))
+	// The first printer free gets the file
+	startFarm(t, store, busy, other)
+	printer := farm.Printers()[0]
+	// Sits out the next pass, so the other printer takes the file
+	waitFor(t, "file to start on the other printer", func() bool { return other.Status().State == Printing })
+	if status := printer.GetStatus(); status != Standby {
+		t.Errorf("rejecting printer status = %d, want Standby", status)
+	}
+	if file, _ := storedFile(store, "job-1", 0); file.Attempts != 0 || len(file.FailedOn) != 0 || file.PrinterId != "1" {
+		t.Errorf("requeued file has attempts %d, failed on %v, on printer %q", file.Attempts, file.FailedOn, file.PrinterId)
+	}
+	if n := testutil.ToFloat64(printsFinished.WithLabelValues("0", "PLA", "errored")); n != errored {
+		t.Errorf("rejected start counted as %v errored prints", n-errored)
+	}
+	busy.update(func(s *PrinterStatus) {})
+	if printer.SittingOut() {
+		t.Error("printer still sitting out after reporting in")
+	}
+}
+
+func TestFailedFileNoOtherPrinterCanTakeFails(t *testing.T) {
+	store := NewMemoryStore()
+	store.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	failing, other := newFakeDriver("printer-0"), newFakeDriver("printer-1")
+	startFarm(t, store, failing, other)
+	waitFor(t, "first attempt to start", func() bool { return failing.Status().State == Printing })
+	farm.Printers()[1].setCapabilities(Capabilities{Materials: []string{"PETG"}})
+
+	failing.update(func(s *PrinterStatus) {
+		s.State = E
+		s.Message = "Heater extruder not heating at expected rate"
+	})
+	waitFor(t, "file to fail", fileHasStatus(store, "job-1", 0, GcodeError))
+	if file, _ := storedFile(store, "job-1", 0); !strings.Contains(file.Message, "no printer runs PLA") {
+		t.Errorf("failed file message = %q", file.Message)
+	}
+	if uploads := other.Uploads(); len(uploads) != 0 {
+		t.Errorf("uploads = %v to a printer that doesn't run PLA", uploads)
+	}
+}
+
+func TestShutdownLeavesPrintsRunning(t *testing.T) {
+	mem := NewMemoryStore()
+	mem.PutJob(jobFromFalseDocument(t, "job-1", falseJobDocument()))
+	store := newMeteredStore(mem)
+	d := newFakeDriver("printer-0")
+	startFarm(t, store, d)
+	waitFor(t, "file to start printing", fileHasStatus(mem, "job-1", 0, GcodePrinting))
+	waitFor(t, "print to start", func() bool { return d.Status().State == Printing })
+
+	var workers sync.WaitGroup
+	shutdown(&workers, store)
+	if !d.isClosed() {
+		t.Error("printer session left open")
+	}
+	if state := d.Status().State; state != Printing {
+		t.Errorf("printer state = %d, want Printing", state)
+	}
+	gcode, _ := storedFile(mem, "job-1", 0)
+	if gcode.Status != GcodePrinting {
+		t.Errorf("file status = %d, want Printing", gcode.Status)
+	}
+	if err := store.UpdateFileStatus(context.Background(), gcode); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("write after shutdown: %v", err)
+	}
+}
+
+// Runs the lifecycle against a Firestore emulator, when one is available:
+// FIRESTORE_EMULATOR_HOST=localhost:8080 go test ./...
+func TestFirestoreEmulatorLifecycle(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set")
+	}
+	viper.Set("database.projectId", "farm-node-test")
+	ctx := context.Background()
+	client, err := FirebaseInstance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	jobId := addFalseDocumentToJobsCollection(ctx, client)
+	if jobId == "" {
+		t.Fatal("could not add a job")
+	}
+	runLifecycle(t, NewFirestoreStore(client), jobId, func() (Job, bool) {
+		doc, err := client.Doc("completed_jobs/" + jobId).Get(ctx)
+		if err != nil {
+			return Job{}, false
+		}
+		return jobFromDocument(doc), true
+	})
+}
+
+// Printers that can't be timed are left out of the projection, and a file
+// a free printer can take starts now rather than at the current time
+func TestProjectQueue(t *testing.T) {
+	free := newPrint(PrinterConfig{Id: "0"}, newFakeDriver("printer-0"))
+	broken := newPrint(PrinterConfig{Id: "1"}, newFakeDriver("printer-1"))
+	broken.SetStatus(Maintenance)
+	busyDriver := newFakeDriver("printer-2")
+	busy := newPrint(PrinterConfig{Id: "2"}, busyDriver)
+	current := jobFromFalseDocument(t, "job-0", falseJobDocument()).GcodeFiles[0]
+	current.Time = 30
+	busy.setCurrentFile(&current, func() {})
+	busy.SetStatus(Printing)
+	busyDriver.update(func(s *PrinterStatus) { s.Progress = 0.5 })
+
+	var queue []GcodeFile
+	for _, id := range []string{"job-1", "job-2", "job-3"} {
+		queue = append(queue, jobFromFalseDocument(t, id, falseJobDocument()).GcodeFiles[0])
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	projections := projectQueue(queue, []*Print{free, broken, busy}, now)
+
+	want := []struct {
+		startsNow bool
+		start     time.Time
+	}{
+		{startsNow: true},
+		{start: now.Add(15 * time.Minute)},
+		{start: now.Add(45 * time.Minute)},
+	}
+	for i, w := range want {
+		proj := projections[i]
+		if proj.Position != i+1 || proj.StartsNow != w.startsNow || !proj.ProjectedStart.Equal(w.start) {
+			t.Errorf("file %d: position %d, starts now %v, projected start %v; want starts now %v, %v",
+				i, proj.Position, proj.StartsNow, proj.ProjectedStart, w.startsNow, w.start)
+		}
+	}
+
+	// With the free printer gone too, nothing can be timed
+	free.driver.(*fakeDriver).setConnState(ConnOffline)
+	for _, proj := range projectQueue(queue[:1], []*Print{free, broken}, now) {
+		if proj.StartsNow || !proj.ProjectedStart.IsZero() {
+			t.Errorf("projected %+v with no printer to take it", proj)
+		}
+	}
+}
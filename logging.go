@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Everything logs through here. Printers, jobs and files add their own
+// fields, see printerLog and fileFields
+var logger = logrus.New()
+
+// Sets up the logger from the [log] section of the config
+//
+//	level   trace, debug, info, warn or error, info by default
+//	format  "text" for logfmt, or "json"
+//	dir     also writes each printer's entries to its own file here
+func setupLogging() error {
+	level := logrus.InfoLevel
+	if viper.IsSet("log.level") {
+		var err error
+		level, err = logrus.ParseLevel(viper.GetString("log.level"))
+		if err != nil {
+			return err
+		}
+	}
+	logger.SetLevel(level)
+
+	switch format := viper.GetString("log.format"); format {
+	case "", "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	if dir := viper.GetString("log.dir"); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		printerFiles = &printerLogFiles{dir: dir, formatter: logger.Formatter, files: make(map[string]*os.File)}
+		logger.AddHook(printerFiles)
+	}
+	return nil
+}
+
+// Logs about one printer, keyed by its host:port
+func printerLog(name string) *logrus.Entry {
+	return logger.WithField("printer", name)
+}
+
+// Identifies a G-code file in log entries
+func fileFields(GF GcodeFile) logrus.Fields {
+	return logrus.Fields{"job": GF.JobId, "file": GF.FileIndex}
+}
+
+// Logs about a job as a whole
+func jobLog(jobId string) *logrus.Entry {
+	return logger.WithField("job", jobId)
+}
+
+// Per-printer log files, when log.dir is set
+var printerFiles *printerLogFiles
+
+// printerLogFiles copies every entry with a printer field to that printer's
+// file, alongside the main log
+type printerLogFiles struct {
+	dir       string
+	formatter logrus.Formatter
+
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+func (h *printerLogFiles) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *printerLogFiles) Fire(entry *logrus.Entry) error {
+	name, ok := entry.Data["printer"].(string)
+	if !ok {
+		return nil
+	}
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, ok := h.files[name]
+	if !ok {
+		path := filepath.Join(h.dir, strings.ReplaceAll(name, ":", "_")+".log")
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		h.files[name] = f
+	}
+	_, err = f.Write(line)
+	return err
+}
+
+// Closes the printer files, reopening them if anything logs afterwards
+func (h *printerLogFiles) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, f := range h.files {
+		f.Close()
+		delete(h.files, name)
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
@@ -12,20 +17,25 @@ const (
 	GcodePrinting     = 1
 	GcodePrintSuccess = 2
 	GcodeCanceled     = 3
+	GcodePaused       = 4
 	GcodeError        = 9
 
 	JobIdle       = 0
 	JobInProgress = 1
 	JobCompleted  = 2
-)
-
-var (
-	jobs         = []Job{}
-	printerArray []*Print
-	gcodeQueue   []GcodeFile
+	JobCanceled   = 3
 )
 
 func main() {
+	// The simulator stands in for printers and needs no config
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := runSimulate(os.Args[2:]); err != nil {
+			fmt.Println("simulate:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	viper.SetConfigName("development")
 	viper.SetConfigType("toml")
 	viper.AddConfigPath("./config")
@@ -33,33 +43,93 @@ func main() {
 	if err != nil {
 		panic(fmt.Errorf("fatal error config file: %w", err))
 	}
-
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		fmt.Println("Config file changed:", e.Name)
-	})
-	viper.WatchConfig()
+	if err := setupLogging(); err != nil {
+		panic(fmt.Errorf("fatal error in log config: %w", err))
+	}
+	loadSettings()
+
+	// Subcommands run once and exit
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sync":
+			if err := runSync(); err != nil {
+				logger.Fatal("sync: ", err)
+			}
+		default:
+			fmt.Println("unknown command:", os.Args[1])
+			os.Exit(2)
+		}
+		return
+	}
 
 	// Will need error handling
 	instantiateAllPrinters()
 
-	// Get firebase instance
-	client, ctx, err := FirebaseInstance()
+	// Everything stops taking new work on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Open the job store, Firestore unless configured otherwise
+	store, err := newJobStore(ctx)
 	if err != nil {
 		panic(err)
 	}
 
-	// Spin-off snapshot worker
-	go jobsSnapshot(ctx, client)
+	gcodeSource, err = newGcodeSource(ctx)
+	if err != nil {
+		panic(err)
+	}
 
-	go managePrintJobs(ctx, client)
+	queueOrder, err := loadQueueOrder()
+	if err != nil {
+		panic(err)
+	}
+	farm.SetQueueOrder(queueOrder)
 
-	go maintainFirestore(ctx, client)
+	// Pick up where the last run left off before queueing anything
+	if err := reconcileStartup(ctx, store); err != nil {
+		panic(err)
+	}
 
-	//go addFalseDocumentToJobsCollection(ctx, client)
+	// The workers all return once ctx is done
+	var workers sync.WaitGroup
+	start := func(work func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			work()
+		}()
+	}
 
-	// Wait forever!
-	for {
+	// Spin-off snapshot worker
+	start(func() { jobsSnapshot(ctx, store) })
 
+	scheduler, err := newScheduler()
+	if err != nil {
+		panic(err)
 	}
+	start(func() { managePrintJobs(ctx, store, scheduler) })
+
+	start(func() { maintainJobStore(ctx, store) })
+
+	start(func() { publishQueue(ctx, store) })
+
+	start(func() { serveAPI(ctx, store) })
+
+	// Printers added, removed or moved in the config are picked up live
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		logger.Info("config file changed: ", e.Name)
+		loadSettings()
+		if ctx.Err() == nil {
+			reloadPrinters(ctx, store, loadPrinterConfigs())
+		}
+	})
+	viper.WatchConfig()
+
+	//go addFalseDocumentToJobsCollection(ctx, client)
 
+	<-ctx.Done()
+	// A second signal stops the node at once
+	stop()
+	shutdown(&workers, store)
 }
@@ -2,98 +2,114 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"os"
-	"sync"
+	"errors"
 	"time"
-
-	"cloud.google.com/go/firestore"
-	"github.com/spf13/viper"
 )
 
 // Parses the toml config for printer host and ports, creates printer objects,
 // and stores Printer pointers in array
 func instantiateAllPrinters() {
-	printers := viper.GetStringMap("printers")
+	configs := loadPrinterConfigs()
 
-	if len(printers) == 0 {
-		fmt.Println("No printers in config")
-		os.Exit(1)
+	if len(configs) == 0 {
+		logger.Fatal("no printers in config")
 	}
 
-	for i := range printers {
-		printer_host := "printers." + i + ".host"
-		printer_port := "printers." + i + ".port"
-
-		// fmt.Printf("%s, %s\n", viper.GetString(printer_host), viper.GetString(printer_port))
-
-		p := NewPrinter(viper.GetString(printer_host), viper.GetString(printer_port))
-
-		printerArray = append(printerArray, p)
-	}
-}
-
-func managePrintJobs(ctx context.Context, client *firestore.Client) {
-
-	// Just keep looping until a GF is in queue
-	for range time.Tick(time.Second * 10) {
-
-		// if gcodeQueue is empty
-		if len(gcodeQueue) == 0 {
-			continue
+	for _, cfg := range configs {
+		p, err := NewPrinter(cfg)
+		if err != nil {
+			logger.Fatal(err)
 		}
 
-		gcode := popFromGcodeQueue()
-		printer := findPrinterToHandleFile(gcode)
-		assignFileToPrinter(printer, gcode, ctx, client)
-
-	}
-}
-
-// pops gcodeFile from global GcodeFile queue
-func popFromGcodeQueue() GcodeFile {
-	var m sync.Mutex
-
-	m.Lock()
-	gcode := gcodeQueue[0]
-	gcodeQueue = gcodeQueue[1:]
-	m.Unlock()
-
-	return gcode
-}
-
-// Have printers call method to update their status
-func updatePrinterStatus() {
-	for i := range printerArray {
-		printerArray[i].RequestPrintStatus()
+		farm.AddPrinter(p)
 	}
+	printerConfigs.Lock()
+	printerConfigs.configs = configs
+	printerConfigs.Unlock()
 }
 
-// Given a GcodeFile, return a printer to handle it
-func findPrinterToHandleFile(gcode GcodeFile) *Print {
+// Hands queued files to printers as the scheduler sees fit, running a new
+// pass whenever the queue or any printer changes
+func managePrintJobs(ctx context.Context, store JobStore, scheduler Scheduler) {
 	for {
-		updatePrinterStatus()
-		for i := range printerArray {
-			printer := printerArray[i]
-			if (printer.LastUsedColor == gcode.Filament.Color &&
-				printer.LastUsedMaterial == gcode.Filament.Material) &&
-				printer.GetStatus() == Standby {
-				return printer
+		queueWait := farm.QueueChanged()
+		printerWait := printerUpdates.Wait()
+
+		printers := farm.Printers()
+		queue := farm.Queue()
+		schedulable := queue[:0:0]
+		// While the printer list is changing, or empty because the config
+		// has none yet, files wait rather than fail for fitting nothing
+		settling := farm.PrintersSettling()
+		checkFit := len(printers) > 0 && settling == 0
+		for _, gcode := range queue {
+			// Waiting is pointless for a part no printer can take
+			if reason := unfitReason(gcode, printers); checkFit && reason != "" {
+				if farm.RemoveGcode(gcode) {
+					gcode.SetStatusMessage(GcodeError, reason)
+					UpdateFileStatus(gcode, ctx, store)
+				}
+				continue
 			}
+			schedulable = append(schedulable, gcode)
 		}
-		for i := range printerArray {
-			printer := printerArray[i]
-			if printer.GetStatus() == Standby {
-				return printer
+
+		for _, a := range scheduler.Assign(schedulable, snapshotPrinters(printers)) {
+			// Nothing new is started once the node is shutting down
+			if ctx.Err() != nil {
+				return
+			}
+			if farm.ClaimGcode(a.File, a.Printer) {
+				assignFileToPrinter(a.Printer, a.File, ctx, store)
 			}
 		}
+
+		var settled <-chan time.Time
+		if settling > 0 {
+			settled = time.After(settling)
+		}
+		select {
+		case <-queueWait:
+		case <-printerWait:
+		case <-settled:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
+// Signaled whenever any printer's status or connection changes
+var printerUpdates Signal
+
 // Spins off a thread for a printer method to handle a file. Update that
 // file's status in the database
-func assignFileToPrinter(printer *Print, gcode GcodeFile, ctx context.Context, client *firestore.Client) {
-	go printer.HandlePrintRequest(gcode, ctx, client)
+func assignFileToPrinter(printer *Print, gcode GcodeFile, ctx context.Context, store JobStore) {
+	// Claim the printer before handing off, so the next pass of the
+	// scheduler can't pick it again
+	if !printer.claim() {
+		// Left the config since the pass began; the file waits for another
+		farm.ReleaseGcode(gcode, printer)
+		farm.OfferGcode(gcode)
+		return
+	}
+	// Record the file as printing before the handler can record anything
+	// later, like a failed upload
 	gcode.SetStatus(GcodePrinting)
-	UpdateFileStatus(gcode, ctx, client)
+	gcode.PrinterId = printer.Id
+	gcode.StartedAt = time.Now()
+	err := UpdateFileStatus(gcode, ctx, store)
+	if errors.Is(err, ErrFileChanged) || errors.Is(err, ErrShuttingDown) {
+		// Canceled or replaced since it was queued, in which case the
+		// snapshot will bring the queue up to date, or too late to start
+		farm.ReleaseGcode(gcode, printer)
+		printer.SetStatus(Standby)
+		return
+	}
+	printsStarted.WithLabelValues(printer.Id, gcode.Material).Inc()
+	// EnqueuedAt is kept across retries, so only a first attempt tells
+	// how long the file waited
+	if !gcode.EnqueuedAt.IsZero() && gcode.Attempts == 0 {
+		queueWait.Observe(gcode.StartedAt.Sub(gcode.EnqueuedAt).Seconds())
+	}
+	printer.startHandler(ctx, func(ctx context.Context) { printer.HandlePrintRequest(gcode, ctx, store) })
 }
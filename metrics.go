@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Counters and histograms, updated as things happen. Printer gauges and
+// queue depth are read off the farm when scraped, by farmCollector
+var (
+	printsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "farm_prints_started_total",
+		Help: "Files handed to a printer.",
+	}, []string{"printer", "material"})
+	printsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "farm_prints_finished_total",
+		Help: "Prints that ended, by result: completed, canceled or errored.",
+	}, []string{"printer", "material", "result"})
+	queueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "farm_queue_wait_seconds",
+		Help:    "Time files waited in the queue before going to a printer.",
+		Buckets: prometheus.ExponentialBuckets(60, 2, 12),
+	})
+	storeWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "farm_store_write_duration_seconds",
+		Help:    "Latency of writes to the job store.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	storeWriteErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "farm_store_write_errors_total",
+		Help: "Writes to the job store that failed.",
+	}, []string{"operation"})
+	jsonrpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "farm_jsonrpc_duration_seconds",
+		Help:    "Round trip of JSON RPC calls to Moonraker, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(farmCollector{})
+}
+
+// Serves every registered metric in the Prometheus text format
+var metricsHandler = promhttp.Handler()
+
+// Counts a print that ended on a printer. Files withdrawn before any
+// printer had them aren't prints
+func recordPrintResult(gcode GcodeFile) {
+	if gcode.PrinterId == "" {
+		return
+	}
+	var result string
+	switch gcode.Status {
+	case GcodePrintSuccess:
+		result = "completed"
+	case GcodeCanceled:
+		result = "canceled"
+	case GcodeError:
+		result = "errored"
+	default:
+		return
+	}
+	printsFinished.WithLabelValues(gcode.PrinterId, gcode.Material, result).Inc()
+}
+
+// meteredStore times the writes of the JobStore it wraps. It also holds
+// them at its writeGate, so closing it lets writes under way finish first
+type meteredStore struct {
+	JobStore
+	writes *writeGate
+}
+
+func newMeteredStore(store JobStore) meteredStore {
+	return meteredStore{JobStore: store, writes: new(writeGate)}
+}
+
+// Times a write to the store, counting it as an error unless it only found
+// the file had changed. The write is not cut off if ctx is canceled part way
+func (s meteredStore) observeWrite(ctx context.Context, operation string, write func(ctx context.Context) error) error {
+	if !s.writes.enter() {
+		return ErrShuttingDown
+	}
+	defer s.writes.leave()
+	start := time.Now()
+	err := write(detachedContext{ctx})
+	storeWriteDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, ErrFileChanged) && !errors.Is(err, errJobNotFinished) {
+		storeWriteErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
+
+func (s meteredStore) UpdateFileStatus(ctx context.Context, gcode GcodeFile) error {
+	return s.observeWrite(ctx, "update_file_status", func(ctx context.Context) error { return s.JobStore.UpdateFileStatus(ctx, gcode) })
+}
+
+func (s meteredStore) RecordEnqueued(ctx context.Context, gcode GcodeFile) error {
+	return s.observeWrite(ctx, "record_enqueued", func(ctx context.Context) error { return s.JobStore.RecordEnqueued(ctx, gcode) })
+}
+
+func (s meteredStore) ArchiveJob(ctx context.Context, jobId string) error {
+	return s.observeWrite(ctx, "archive_job", func(ctx context.Context) error { return s.JobStore.ArchiveJob(ctx, jobId) })
+}
+
+func (s meteredStore) PruneArchive(ctx context.Context, cutoff time.Time) error {
+	return s.observeWrite(ctx, "prune_archive", func(ctx context.Context) error { return s.JobStore.PruneArchive(ctx, cutoff) })
+}
+
+func (s meteredStore) ClearControl(ctx context.Context, jobId string, control string) error {
+	return s.observeWrite(ctx, "clear_control", func(ctx context.Context) error { return s.JobStore.ClearControl(ctx, jobId, control) })
+}
+
+func (s meteredStore) UpdateQueueProjection(ctx context.Context, proj QueueProjection) error {
+	return s.observeWrite(ctx, "update_queue_projection", func(ctx context.Context) error { return s.JobStore.UpdateQueueProjection(ctx, proj) })
+}
+
+func (s meteredStore) ClearQueueProjection(ctx context.Context, gcode GcodeFile) error {
+	return s.observeWrite(ctx, "clear_queue_projection", func(ctx context.Context) error { return s.JobStore.ClearQueueProjection(ctx, gcode) })
+}
+
+// Waits for the writes under way, then closes the store
+func (s meteredStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.writes.close(ctx); err != nil {
+		logger.Warn("closing the store with writes under way")
+	}
+	return s.JobStore.Close()
+}
+
+var (
+	printerStatusDesc = prometheus.NewDesc("farm_printer_status",
+		"Where the printer is in the print cycle, as a printer status code.", []string{"printer"}, nil)
+	printerOnlineDesc = prometheus.NewDesc("farm_printer_online",
+		"1 while farm-node is connected to the printer.", []string{"printer"}, nil)
+	printerProgressDesc = prometheus.NewDesc("farm_printer_progress",
+		"Progress of the current print, 0 to 1.", []string{"printer"}, nil)
+	printerHotendDesc = prometheus.NewDesc("farm_printer_hotend_temperature_celsius",
+		"Hotend temperature.", []string{"printer"}, nil)
+	printerBedDesc = prometheus.NewDesc("farm_printer_bed_temperature_celsius",
+		"Bed temperature.", []string{"printer"}, nil)
+	printerUtilizationDesc = prometheus.NewDesc("farm_printer_utilization",
+		"Share of time the printer has spent out of standby since it was added.", []string{"printer"}, nil)
+	queueDepthDesc = prometheus.NewDesc("farm_queue_depth",
+		"Files waiting in the queue.", nil, nil)
+)
+
+// farmCollector reports the printers and queue as they are at scrape time
+type farmCollector struct{}
+
+func (farmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- printerStatusDesc
+	ch <- printerOnlineDesc
+	ch <- printerProgressDesc
+	ch <- printerHotendDesc
+	ch <- printerBedDesc
+	ch <- printerUtilizationDesc
+	ch <- queueDepthDesc
+}
+
+func (farmCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range farm.Printers() {
+		status := p.PrinterStatus()
+		online := 0.0
+		if p.Online() {
+			online = 1
+		}
+		ch <- prometheus.MustNewConstMetric(printerStatusDesc, prometheus.GaugeValue, float64(p.GetStatus()), p.Id)
+		ch <- prometheus.MustNewConstMetric(printerOnlineDesc, prometheus.GaugeValue, online, p.Id)
+		ch <- prometheus.MustNewConstMetric(printerProgressDesc, prometheus.GaugeValue, status.Progress, p.Id)
+		ch <- prometheus.MustNewConstMetric(printerHotendDesc, prometheus.GaugeValue, status.HotendTemp, p.Id)
+		ch <- prometheus.MustNewConstMetric(printerBedDesc, prometheus.GaugeValue, status.BedTemp, p.Id)
+		ch <- prometheus.MustNewConstMetric(printerUtilizationDesc, prometheus.GaugeValue, p.Utilization(), p.Id)
+	}
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(farm.QueueLen()))
+}
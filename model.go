@@ -1,33 +1,104 @@
 package main
 
+import (
+	"fmt"
+	"time"
+)
+
 type Job struct {
-	JobId      string
-	GcodeFiles []GcodeFile `firestore:"gcode"`
-	Status     int         `firestore:"status"`
+	JobId      string      `firestore:"-" json:"id"`
+	GcodeFiles []GcodeFile `firestore:"gcode" json:"gcode"`
+	Status     int         `firestore:"status" json:"status"`
+	Priority   int         `firestore:"priority" json:"priority"`
+	DueAt      time.Time   `firestore:"due_at" json:"due_at"`
+	// Command for the job's running prints, cleared once carried out
+	Control string `firestore:"control,omitempty" json:"control,omitempty"`
+	// Set when the job is moved to completed_jobs
+	ArchivedAt time.Time `firestore:"archived_at,omitempty" json:"archived_at,omitempty"`
 }
 
 type GcodeFile struct {
-	JobId     string
-	FileIndex int
-	Filename  string  `firestore:"filename"`
-	Time      float64 `firestore:"time"`
-	Status    int     `firestore:"status"`
-	Filament  `firestore:"filament"`
-	MaxDim    `firestore:"max_dim"`
+	JobId     string  `firestore:"-" json:"-"`
+	FileIndex int     `firestore:"-" json:"-"`
+	Filename  string  `firestore:"filename" json:"filename"`
+	Path      string  `firestore:"path" json:"path,omitempty"`
+	Url       string  `firestore:"url" json:"url,omitempty"`
+	Time      float64 `firestore:"time" json:"time"`
+	Status    int     `firestore:"status" json:"status"`
+	Message   string  `firestore:"message" json:"message,omitempty"`
+	Nozzle    float64 `firestore:"nozzle" json:"nozzle,omitempty"`
+	Filament  `firestore:"filament" json:"filament"`
+	MaxDim    `firestore:"max_dim" json:"max_dim"`
+
+	// Id of the printer handling the file and when it started and
+	// finished, written by UpdateFileStatus
+	PrinterId  string    `firestore:"printer_id" json:"printer_id,omitempty"`
+	StartedAt  time.Time `firestore:"started_at" json:"started_at"`
+	FinishedAt time.Time `firestore:"finished_at" json:"finished_at"`
+	// Prints of the file that failed so far and the printers they failed
+	// on, which it isn't sent back to
+	Attempts int      `firestore:"attempts" json:"attempts,omitempty"`
+	FailedOn []string `firestore:"failed_on" json:"failed_on,omitempty"`
+
+	// When the file was first queued, written by RecordEnqueued. Kept
+	// through retries and restarts, so the file doesn't lose its place
+	EnqueuedAt time.Time `firestore:"enqueued_at" json:"enqueued_at"`
+
+	// Copied from the job, for ordering the queue
+	Priority int       `firestore:"-" json:"-"`
+	DueAt    time.Time `firestore:"-" json:"-"`
+}
+
+// Gives each of the Gcode files the ID of its Job, its index and what it
+// needs of the job for ordering the queue
+func (j *Job) fillFiles() {
+	for i := range j.GcodeFiles {
+		j.GcodeFiles[i].JobId = j.JobId
+		j.GcodeFiles[i].FileIndex = i
+		j.GcodeFiles[i].Priority = j.Priority
+		j.GcodeFiles[i].DueAt = j.DueAt
+	}
 }
 
 type Filament struct {
-	Color    string `firestore:"color"`
-	Material string `firestore:"material"`
-	Process  string `firestore:"process"`
+	Color    string `firestore:"color" json:"color"`
+	Material string `firestore:"material" json:"material"`
+	Process  string `firestore:"process" json:"process"`
 }
 
 type MaxDim struct {
-	Height float64 `firestore:"height"`
-	Length float64 `firestore:"length"`
-	Width  float64 `firestore:"width"`
+	Height float64 `firestore:"height" json:"height"`
+	Length float64 `firestore:"length" json:"length"`
+	Width  float64 `firestore:"width" json:"width"`
+}
+
+// Identifies the file across copies: its job and position in the job
+func (g GcodeFile) Key() string {
+	return fmt.Sprintf("%s/%d", g.JobId, g.FileIndex)
+}
+
+// Whether the file is done with, one way or another
+func (g GcodeFile) Finished() bool {
+	return g.Status == GcodePrintSuccess || g.Status == GcodeCanceled || g.Status == GcodeError
+}
+
+// Whether a print of the file already failed on the printer
+func (g GcodeFile) FailedOnPrinter(printerId string) bool {
+	for _, id := range g.FailedOn {
+		if id == printerId {
+			return true
+		}
+	}
+	return false
 }
 
 func (g *GcodeFile) SetStatus(status int) {
 	g.Status = status
+	g.Message = ""
+}
+
+// Sets the status along with the reason for it
+func (g *GcodeFile) SetStatusMessage(status int, message string) {
+	g.Status = status
+	g.Message = message
 }
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+)
+
+// How long a JSON RPC call waits for its reply before giving up
+const callTimeout = 10 * time.Second
+
+// Moonraker drives a Klipper printer through the Moonraker API: JSON RPC
+// over /websocket, and /server/files/upload for G-code
+type Moonraker struct {
+	driverBase
+	Host string
+	Port string
+	ws   *websocket.Conn
+
+	statusMu sync.Mutex
+	objects  map[string]map[string]interface{}
+	idleFlag bool
+
+	writeMu sync.Mutex
+	callMu  sync.Mutex
+	nextId  int
+	pending map[int]*Call
+}
+
+// Call is a JSON RPC request waiting on its reply from Moonraker
+type Call struct {
+	Request Jsonrpc
+	Sent    time.Time
+	Reply   Jsonrpc
+	Error   error
+	Done    chan *Call
+}
+
+func NewMoonraker(host string, port string) *Moonraker {
+	m := &Moonraker{driverBase: newDriverBase()}
+	m.Host = host
+	m.Port = port
+	m.idleFlag = true
+	m.pending = make(map[int]*Call)
+	m.objects = make(map[string]map[string]interface{})
+	return m
+}
+
+func (m *Moonraker) Name() string {
+	return m.Host + ":" + m.Port
+}
+
+func (m *Moonraker) log() *logrus.Entry {
+	return printerLog(m.Name())
+}
+
+func (m *Moonraker) Connect() {
+	go m.maintainConnection()
+}
+
+// Stops reconnecting and closes the websocket. Prints on the printer are
+// left alone
+func (m *Moonraker) Close() {
+	if !m.markClosed() {
+		return
+	}
+	m.connMu.Lock()
+	ws := m.ws
+	m.connMu.Unlock()
+	if ws != nil {
+		m.writeMu.Lock()
+		ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		m.writeMu.Unlock()
+		ws.Close()
+	}
+}
+
+func (m *Moonraker) dial() error {
+	u := url.URL{Scheme: "ws", Host: m.Host + ":" + m.Port, Path: "/websocket"}
+	m.log().Infof("connecting to %s", u.String())
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return err
+	}
+	m.connMu.Lock()
+	m.ws = ws
+	m.connMu.Unlock()
+	return nil
+}
+
+// Keeps the websocket up until Close. Failed dials are retried with
+// exponential backoff, and every new session refreshes the printer status
+// before the scheduler relies on it again
+func (m *Moonraker) maintainConnection() {
+	attempt := 0
+	for !m.isClosed() {
+		m.setConnState(ConnConnecting)
+		if err := m.dial(); err != nil {
+			m.setConnState(ConnOffline)
+			delay := reconnectDelay(attempt)
+			attempt++
+			m.log().Warnf("dial: %v, retrying in %v", err, delay)
+			if !m.sleep(delay) {
+				return
+			}
+			continue
+		}
+		if m.isClosed() {
+			m.ws.Close()
+			break
+		}
+		attempt = 0
+		m.setConnState(ConnOnline)
+		go m.onConnect()
+
+		err := m.receive()
+		if !m.isClosed() {
+			m.log().Warnf("connection lost: %v", err)
+		}
+		m.setConnState(ConnOffline)
+		m.connMu.Lock()
+		m.ws.Close()
+		m.connMu.Unlock()
+		m.failPendingCalls()
+	}
+	m.setConnState(ConnOffline)
+}
+
+// Subscribes to status updates on every new session, which also replaces
+// whatever was cached before the connection dropped
+func (m *Moonraker) onConnect() {
+	ctx, cancel := m.context()
+	defer cancel()
+	if err := m.Subscribe(ctx); err != nil {
+		m.log().Errorf("subscribe: %v", err)
+	}
+}
+
+// Reads from the websocket until it fails
+func (m *Moonraker) receive() error {
+	for {
+		_, message, err := m.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		m.log().WithField("direction", "recv").Debug(string(message))
+		data, err := JsonUnmarshal(message)
+		if err != nil {
+			m.log().Warn(err)
+			continue
+		}
+		m.ProcessReceivedData(*data)
+	}
+}
+
+func (m *Moonraker) ProcessReceivedData(data Jsonrpc) {
+	// Replies carry the id of the request they answer
+	if data.Method == "" && data.Id != 0 {
+		m.completeCall(data)
+		return
+	}
+
+	// Process data according to method information
+	switch data.Method {
+	case "notify_proc_stat_update":
+		return
+	case "notify_gcode_response":
+		if res, ok := firstParam(data).(string); ok {
+			m.ProcessGcodeResponse(res)
+			return
+		}
+	case "notify_status_update":
+		if delta, ok := firstParam(data).(map[string]interface{}); ok {
+			m.ProcessStatusUpdate(delta)
+			return
+		}
+	default:
+		// Anything else only shows in the debug log of the raw traffic
+		return
+	}
+	m.log().WithField("method", data.Method).Warnf("skipping notification with unexpected params %v", data.Params)
+}
+
+// Notifications carry their payload as the first of their params
+func firstParam(data Jsonrpc) interface{} {
+	params, ok := data.Params.([]interface{})
+	if !ok || len(params) == 0 {
+		return nil
+	}
+	return params[0]
+}
+
+func (m *Moonraker) ProcessGcodeResponse(res string) {
+	m.statusMu.Lock()
+	if strings.Contains(res, "IdleFlag:1.0") {
+		m.idleFlag = true
+	} else if strings.Contains(res, "IdleFlag:0.0") {
+		m.idleFlag = false
+	}
+	m.statusMu.Unlock()
+	m.notifyStatusChanged()
+}
+
+// Merges a notify_status_update delta into the cached status
+func (m *Moonraker) ProcessStatusUpdate(delta map[string]interface{}) {
+	m.statusMu.Lock()
+	mergeStatus(m.objects, delta)
+	m.statusMu.Unlock()
+	m.notifyStatusChanged()
+}
+
+// Returns a snapshot of the cached printer status
+func (m *Moonraker) Status() PrinterStatus {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	status := newPrinterStatus(m.objects, m.idleFlag)
+	status.Upload = m.uploadProgress()
+	return status
+}
+
+// Hands a reply to the Call waiting on its id. Replies nobody is waiting on,
+// either unknown or arriving after the caller gave up, are dropped
+func (m *Moonraker) completeCall(data Jsonrpc) {
+	call, ok := m.forgetCall(data.Id)
+	if !ok {
+		m.log().Debugf("dropping reply to unknown request id %d", data.Id)
+		return
+	}
+
+	jsonrpcDuration.WithLabelValues(call.Request.Method).Observe(time.Since(call.Sent).Seconds())
+	call.Reply = data
+	if data.Error != nil {
+		call.Error = data.Error
+	}
+	call.Done <- call
+}
+
+// Fails every outstanding Call once their replies can no longer arrive
+func (m *Moonraker) failPendingCalls() {
+	m.callMu.Lock()
+	pending := m.pending
+	m.pending = make(map[int]*Call)
+	m.callMu.Unlock()
+
+	for _, call := range pending {
+		call.Error = ErrDisconnected
+		call.Done <- call
+	}
+}
+
+// Removes a pending Call, reporting whether it was still there. Only the
+// one who removed it may deliver it, since Done holds a single Call
+func (m *Moonraker) forgetCall(id int) (*Call, bool) {
+	m.callMu.Lock()
+	defer m.callMu.Unlock()
+	call, ok := m.pending[id]
+	delete(m.pending, id)
+	return call, ok
+}
+
+func (m *Moonraker) SendJsonrpc(data Jsonrpc) error {
+	if !m.Online() {
+		return ErrDisconnected
+	}
+	m.connMu.Lock()
+	ws := m.ws
+	m.connMu.Unlock()
+
+	if logger.IsLevelEnabled(logrus.DebugLevel) {
+		if raw, err := json.Marshal(data); err == nil {
+			m.log().WithField("direction", "send").Debug(string(raw))
+		}
+	}
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := ws.WriteJSON(data); err != nil {
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
+	return nil
+}
+
+// Go sends req under a freshly allocated id and returns without waiting.
+// The Call is delivered on its Done channel once the matching reply arrives
+func (m *Moonraker) Go(req Jsonrpc) *Call {
+	call := &Call{Done: make(chan *Call, 1)}
+
+	m.callMu.Lock()
+	m.nextId++
+	req.Add_id(m.nextId)
+	call.Request = req
+	call.Sent = time.Now()
+	m.pending[req.Id] = call
+	m.callMu.Unlock()
+
+	if err := m.SendJsonrpc(req); err != nil {
+		// failPendingCalls may have delivered it already
+		if _, ok := m.forgetCall(req.Id); ok {
+			call.Error = err
+			call.Done <- call
+		}
+	}
+	return call
+}
+
+// Call sends req and blocks until its reply arrives or ctx is done. A reply
+// carrying an Error_object is returned as the error
+func (m *Moonraker) Call(ctx context.Context, req Jsonrpc) (Jsonrpc, error) {
+	call := m.Go(req)
+	select {
+	case <-call.Done:
+		return call.Reply, call.Error
+	case <-ctx.Done():
+		m.forgetCall(call.Request.Id)
+		return Jsonrpc{}, fmt.Errorf("%s: %w", req.Method, ctx.Err())
+	}
+}
+
+// Call with the default reply deadline
+func (m *Moonraker) callWithTimeout(ctx context.Context, req Jsonrpc) (Jsonrpc, error) {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+	return m.Call(ctx, req)
+}
+
+// Call that rides out dropped connections: waits for the printer to come
+// back and sends again until a reply arrives or ctx is done
+func (m *Moonraker) callWhenOnline(ctx context.Context, req Jsonrpc) (Jsonrpc, error) {
+	for {
+		if err := m.WaitOnline(ctx); err != nil {
+			return Jsonrpc{}, fmt.Errorf("%s: %w", req.Method, err)
+		}
+		callCtx, cancel := context.WithTimeout(ctx, callTimeout)
+		reply, err := m.Call(callCtx, req)
+		cancel()
+		if !errors.Is(err, ErrDisconnected) {
+			return reply, err
+		}
+		m.log().Warnf("%s interrupted, waiting to reconnect", req.Method)
+	}
+}
+
+// Calls a method that takes no parameters
+func (m *Moonraker) callMethod(ctx context.Context, method string) error {
+	Jsonrpc_req := NewJsonrpc()
+	Jsonrpc_req.Add_method(method)
+	_, err := m.callWhenOnline(ctx, Jsonrpc_req)
+	return err
+}
+
+func (m *Moonraker) DisplayMessage(ctx context.Context, GF GcodeFile) error {
+	Script := "DISPLAY_NOTIFICATION "
+	Script += `NAME="` + GF.Filename + `"`
+	Script += ` COLOR="` + GF.Color + `"`
+	Script += ` MATERIAL="` + GF.Material + `"`
+	return m.RequestGcodeScript(ctx, Script)
+}
+
+func (m *Moonraker) DefaultDisplay(ctx context.Context) error {
+	return m.RequestGcodeScript(ctx, "DISPLAY_DEFAULT")
+}
+
+func (m *Moonraker) RequestGcodeScript(ctx context.Context, Script string) error {
+	Jsonrpc_req := NewJsonrpc()
+	Jsonrpc_req.Add_method("printer.gcode.script")
+	Jsonrpc_req.Add_params_script(Script)
+	_, err := m.callWhenOnline(ctx, Jsonrpc_req)
+	return err
+}
+
+// Subscribes to the printer objects we track. The reply carries their full
+// current state, which replaces the cache; deltas follow as
+// notify_status_update
+func (m *Moonraker) Subscribe(ctx context.Context) error {
+	Jsonrpc_req := NewJsonrpc()
+	Jsonrpc_req.Add_method("printer.objects.subscribe")
+	Jsonrpc_req.Add_params_objects(subscribedObjects...)
+	reply, err := m.callWithTimeout(ctx, Jsonrpc_req)
+	if err != nil {
+		return err
+	}
+	result_object, ok := reply.Result.(Result_object)
+	if !ok {
+		return fmt.Errorf("printer.objects.subscribe: unexpected result %v", reply.Result)
+	}
+	status, _ := result_object.Raw["status"].(map[string]interface{})
+
+	m.statusMu.Lock()
+	m.objects = make(map[string]map[string]interface{})
+	mergeStatus(m.objects, status)
+	m.statusMu.Unlock()
+	m.notifyStatusChanged()
+	return nil
+}
+
+func (m *Moonraker) QueryPrint(ctx context.Context) (string, int, error) {
+	Jsonrpc_req := NewJsonrpc()
+	Jsonrpc_req.Add_method("printer.objects.query")
+	Jsonrpc_req.Add_params_objects("print_stats")
+	reply, err := m.callWhenOnline(ctx, Jsonrpc_req)
+	if err != nil {
+		return "", 0, err
+	}
+	result_object, ok := reply.Result.(Result_object)
+	if !ok {
+		return "", 0, fmt.Errorf("printer.objects.query: unexpected result %v", reply.Result)
+	}
+	status, _ := result_object.Raw["status"].(map[string]interface{})
+	var ps Print_stats_object
+	mapstructure.Decode(status["print_stats"], &ps)
+	return ps.Filename, status_code(ps.State), nil
+}
+
+func (m *Moonraker) Start(ctx context.Context, FileName string) error {
+	Jsonrpc_req := NewJsonrpc()
+	Jsonrpc_req.Add_method("printer.print.start")
+	Jsonrpc_req.Add_params_filename(FileName)
+	_, err := m.callWhenOnline(ctx, Jsonrpc_req)
+	return err
+}
+
+func (m *Moonraker) Pause(ctx context.Context) error {
+	return m.callMethod(ctx, "printer.print.pause")
+}
+
+func (m *Moonraker) Resume(ctx context.Context) error {
+	return m.callMethod(ctx, "printer.print.resume")
+}
+
+func (m *Moonraker) Cancel(ctx context.Context) error {
+	return m.callMethod(ctx, "printer.print.cancel")
+}
+
+func (m *Moonraker) EmergencyStop(ctx context.Context) error {
+	return m.callMethod(ctx, "printer.emergency_stop")
+}
+
+// Streams the file to /server/files/upload with its SHA-256, which
+// Moonraker checks on its end, then confirms the stored size
+func (m *Moonraker) Upload(ctx context.Context, GF GcodeFile) error {
+	url := url.URL{Scheme: "http", Host: m.Host + ":" + m.Port, Path: "/server/files/upload"}
+	return uploadWithRetry(ctx, &m.driverBase, m.log(), GF, func(ctx context.Context, body *uploadBody) error {
+		req, err := newMultipartRequest(ctx, url.String(), body, func() map[string]string {
+			return map[string]string{"checksum": body.Checksum()}
+		})
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if err := checkUploadResponse(res); err != nil {
+			return err
+		}
+		return m.verifyUpload(ctx, body)
+	})
+}
+
+// Checks that Moonraker holds the whole file, from its metadata or, if
+// that isn't ready yet, from a listing of the gcodes root
+func (m *Moonraker) verifyUpload(ctx context.Context, body *uploadBody) error {
+	size, err := m.storedSize(ctx, body.Filename)
+	if err != nil {
+		return err
+	}
+	if size != body.Sent() {
+		return fmt.Errorf("upload %s: printer stored %d bytes, sent %d", body.Filename, size, body.Sent())
+	}
+	return nil
+}
+
+func (m *Moonraker) storedSize(ctx context.Context, filename string) (int64, error) {
+	Jsonrpc_req := NewJsonrpc()
+	Jsonrpc_req.Add_method("server.files.metadata")
+	Jsonrpc_req.Add_params_filename(filename)
+	reply, err := m.callWhenOnline(ctx, Jsonrpc_req)
+	if err == nil {
+		if result_object, ok := reply.Result.(Result_object); ok {
+			if size, ok := result_object.Raw["size"].(float64); ok {
+				return int64(size), nil
+			}
+		}
+	}
+
+	Jsonrpc_req = NewJsonrpc()
+	Jsonrpc_req.Add_method("server.files.list")
+	Jsonrpc_req.Add_params_root("gcodes")
+	reply, err = m.callWhenOnline(ctx, Jsonrpc_req)
+	if err != nil {
+		return 0, err
+	}
+	files, _ := reply.Result.([]interface{})
+	for _, f := range files {
+		file, _ := f.(map[string]interface{})
+		path, _ := file["path"].(string)
+		if path == "" {
+			path, _ = file["filename"].(string)
+		}
+		if path == filename {
+			size, _ := file["size"].(float64)
+			return int64(size), nil
+		}
+	}
+	return 0, fmt.Errorf("upload %s: file missing from printer after upload", filename)
+}
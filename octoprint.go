@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// OctoPrint drives a printer through the OctoPrint REST API, with status
+// pushed over its SockJS socket. The IdleFlag follows the same convention
+// as on Klipper: the printer echoes "IdleFlag:1.0" or "IdleFlag:0.0" (for
+// example with M118 from a custom menu item) and we pick it out of the
+// terminal log
+type OctoPrint struct {
+	driverBase
+	Host   string
+	Port   string
+	ApiKey string
+	ws     *websocket.Conn
+	client *http.Client
+
+	statusMu sync.Mutex
+	status   PrinterStatus
+	// Outcome of the last print, reported once the printer is back to
+	// operational, like print_stats does on Klipper
+	lastResult int
+}
+
+// Fields of OctoPrint's "current" and "history" push messages we use
+type octoCurrent struct {
+	State struct {
+		Text  string `json:"text"`
+		Flags struct {
+			Operational bool `json:"operational"`
+			Printing    bool `json:"printing"`
+			Cancelling  bool `json:"cancelling"`
+			Pausing     bool `json:"pausing"`
+			Paused      bool `json:"paused"`
+			Error       bool `json:"error"`
+		} `json:"flags"`
+	} `json:"state"`
+	Job struct {
+		File struct {
+			Name string `json:"name"`
+		} `json:"file"`
+	} `json:"job"`
+	Progress struct {
+		Completion *float64 `json:"completion"`
+	} `json:"progress"`
+	Temps []struct {
+		Tool0 *octoTemp `json:"tool0"`
+		Bed   *octoTemp `json:"bed"`
+	} `json:"temps"`
+	Logs []string `json:"logs"`
+}
+
+type octoTemp struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+}
+
+type octoEvent struct {
+	Type    string `json:"type"`
+	Payload struct {
+		Reason string `json:"reason"`
+		Error  string `json:"error"`
+	} `json:"payload"`
+}
+
+func NewOctoPrint(host string, port string, apiKey string) *OctoPrint {
+	o := &OctoPrint{driverBase: newDriverBase()}
+	o.Host = host
+	o.Port = port
+	o.ApiKey = apiKey
+	o.client = &http.Client{}
+	o.status.State = Standby
+	o.status.IdleFlag = true
+	o.lastResult = Standby
+	return o
+}
+
+func (o *OctoPrint) Name() string {
+	return o.Host + ":" + o.Port
+}
+
+func (o *OctoPrint) log() *logrus.Entry {
+	return printerLog(o.Name())
+}
+
+func (o *OctoPrint) Connect() {
+	go o.maintainConnection()
+}
+
+// Stops reconnecting and closes the socket. Prints on the printer are left
+// alone
+func (o *OctoPrint) Close() {
+	if !o.markClosed() {
+		return
+	}
+	o.connMu.Lock()
+	ws := o.ws
+	o.connMu.Unlock()
+	if ws != nil {
+		ws.Close()
+	}
+}
+
+// Logs in for a socket session and opens the raw SockJS websocket
+func (o *OctoPrint) dial(ctx context.Context) error {
+	var login struct {
+		Name    string `json:"name"`
+		Session string `json:"session"`
+	}
+	if err := o.request(ctx, "POST", "/api/login", map[string]interface{}{"passive": true}, &login); err != nil {
+		return err
+	}
+
+	u := url.URL{Scheme: "ws", Host: o.Host + ":" + o.Port, Path: "/sockjs/websocket"}
+	o.log().Infof("connecting to %s", u.String())
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	auth := map[string]string{"auth": login.Name + ":" + login.Session}
+	if err := ws.WriteJSON(auth); err != nil {
+		ws.Close()
+		return err
+	}
+	o.connMu.Lock()
+	o.ws = ws
+	o.connMu.Unlock()
+	return nil
+}
+
+// Keeps the socket up until Close, redialing with exponential backoff
+func (o *OctoPrint) maintainConnection() {
+	attempt := 0
+	for !o.isClosed() {
+		o.setConnState(ConnConnecting)
+		ctx, cancel := o.context()
+		err := o.dial(ctx)
+		cancel()
+		if err != nil {
+			o.setConnState(ConnOffline)
+			delay := reconnectDelay(attempt)
+			attempt++
+			o.log().Warnf("dial: %v, retrying in %v", err, delay)
+			if !o.sleep(delay) {
+				return
+			}
+			continue
+		}
+		if o.isClosed() {
+			o.ws.Close()
+			break
+		}
+		attempt = 0
+		o.setConnState(ConnOnline)
+
+		err = o.receive()
+		if !o.isClosed() {
+			o.log().Warnf("connection lost: %v", err)
+		}
+		o.setConnState(ConnOffline)
+		o.ws.Close()
+	}
+	o.setConnState(ConnOffline)
+}
+
+// Reads push messages until the socket fails or OctoPrint asks us to
+// log in again
+func (o *OctoPrint) receive() error {
+	for {
+		_, message, err := o.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		o.log().WithField("direction", "recv").Debug(string(message))
+		for _, frame := range sockjsFrames(message) {
+			var msg map[string]json.RawMessage
+			if err := json.Unmarshal(frame, &msg); err != nil {
+				o.log().Warn(err)
+				continue
+			}
+			if _, ok := msg["reauthRequired"]; ok {
+				return fmt.Errorf("reauthentication required")
+			}
+			o.processMessage(msg)
+		}
+	}
+}
+
+// Unpacks SockJS framing if the server used it; raw websocket messages
+// are returned as is
+func sockjsFrames(message []byte) [][]byte {
+	if len(message) == 0 {
+		return nil
+	}
+	switch message[0] {
+	case 'o', 'h', 'c':
+		return nil
+	case 'a':
+		var frames []string
+		if err := json.Unmarshal(message[1:], &frames); err != nil {
+			return nil
+		}
+		out := make([][]byte, len(frames))
+		for i := range frames {
+			out[i] = []byte(frames[i])
+		}
+		return out
+	}
+	return [][]byte{message}
+}
+
+func (o *OctoPrint) processMessage(msg map[string]json.RawMessage) {
+	for _, key := range []string{"current", "history"} {
+		if raw, ok := msg[key]; ok {
+			var current octoCurrent
+			if err := json.Unmarshal(raw, &current); err != nil {
+				o.log().Warn(err)
+				continue
+			}
+			o.processCurrent(current)
+		}
+	}
+	if raw, ok := msg["event"]; ok {
+		var event octoEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			o.log().Warn(err)
+			return
+		}
+		o.processEvent(event)
+	}
+}
+
+func (o *OctoPrint) processCurrent(current octoCurrent) {
+	o.statusMu.Lock()
+	flags := current.State.Flags
+	switch {
+	case flags.Error:
+		o.status.State = E
+		o.status.Message = current.State.Text
+	case flags.Paused || flags.Pausing:
+		o.status.State = Paused
+	case flags.Printing || flags.Cancelling:
+		o.status.State = Printing
+	default:
+		o.status.State = o.lastResult
+	}
+	o.status.StateMessage = current.State.Text
+	if current.Job.File.Name != "" {
+		o.status.Filename = current.Job.File.Name
+	}
+	if current.Progress.Completion != nil {
+		o.status.Progress = *current.Progress.Completion / 100
+	}
+	if n := len(current.Temps); n > 0 {
+		if t := current.Temps[n-1].Tool0; t != nil {
+			o.status.HotendTemp = t.Actual
+			o.status.HotendTarget = t.Target
+		}
+		if t := current.Temps[n-1].Bed; t != nil {
+			o.status.BedTemp = t.Actual
+			o.status.BedTarget = t.Target
+		}
+	}
+	for _, line := range current.Logs {
+		if strings.Contains(line, "IdleFlag:1.0") {
+			o.status.IdleFlag = true
+		} else if strings.Contains(line, "IdleFlag:0.0") {
+			o.status.IdleFlag = false
+		}
+	}
+	o.statusMu.Unlock()
+	o.notifyStatusChanged()
+}
+
+func (o *OctoPrint) processEvent(event octoEvent) {
+	o.statusMu.Lock()
+	switch event.Type {
+	case "PrintStarted":
+		o.lastResult = Standby
+		o.status.Message = ""
+	case "PrintDone":
+		o.lastResult = Completed
+	case "PrintCancelled":
+		o.lastResult = Canceled
+	case "PrintFailed":
+		if event.Payload.Reason == "cancelled" {
+			o.lastResult = Canceled
+		} else {
+			o.lastResult = E
+			o.status.Message = event.Payload.Error
+		}
+	default:
+		o.statusMu.Unlock()
+		return
+	}
+	o.status.State = o.lastResult
+	o.statusMu.Unlock()
+	o.notifyStatusChanged()
+}
+
+func (o *OctoPrint) Status() PrinterStatus {
+	o.statusMu.Lock()
+	status := o.status
+	o.statusMu.Unlock()
+	status.Upload = o.uploadProgress()
+	return status
+}
+
+// Sends a JSON request to the REST API and decodes the reply into out, if
+// given
+func (o *OctoPrint) request(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	u := url.URL{Scheme: "http", Host: o.Host + ":" + o.Port, Path: path}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), payload)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return o.do(req, out)
+}
+
+func (o *OctoPrint) do(req *http.Request, out interface{}) error {
+	req.Header.Set("X-Api-Key", o.ApiKey)
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+// Sends G-code lines to the printer through OctoPrint's terminal
+func (o *OctoPrint) sendCommands(ctx context.Context, commands ...string) error {
+	return o.request(ctx, "POST", "/api/printer/command", map[string]interface{}{"commands": commands}, nil)
+}
+
+// Streams the file to local storage, then confirms the size OctoPrint
+// stored
+func (o *OctoPrint) Upload(ctx context.Context, GF GcodeFile) error {
+	u := url.URL{Scheme: "http", Host: o.Host + ":" + o.Port, Path: "/api/files/local"}
+	return uploadWithRetry(ctx, &o.driverBase, o.log(), GF, func(ctx context.Context, body *uploadBody) error {
+		req, err := newMultipartRequest(ctx, u.String(), body, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Api-Key", o.ApiKey)
+		res, err := o.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if err := checkUploadResponse(res); err != nil {
+			return err
+		}
+
+		var stored struct {
+			Size int64 `json:"size"`
+		}
+		if err := o.request(ctx, "GET", "/api/files/local/"+url.PathEscape(body.Filename), nil, &stored); err != nil {
+			return err
+		}
+		if stored.Size != body.Sent() {
+			return fmt.Errorf("upload %s: printer stored %d bytes, sent %d", body.Filename, stored.Size, body.Sent())
+		}
+		return nil
+	})
+}
+
+func (o *OctoPrint) QueryPrint(ctx context.Context) (string, int, error) {
+	var job struct {
+		Job struct {
+			File struct {
+				Name string `json:"name"`
+			} `json:"file"`
+		} `json:"job"`
+		State string `json:"state"`
+	}
+	if err := o.request(ctx, "GET", "/api/job", nil, &job); err != nil {
+		return "", 0, err
+	}
+	state := Standby
+	switch {
+	case job.State == "Printing" || job.State == "Cancelling":
+		state = Printing
+	case job.State == "Paused" || job.State == "Pausing":
+		state = Paused
+	case strings.HasPrefix(job.State, "Error"):
+		state = E
+	}
+	return job.Job.File.Name, state, nil
+}
+
+func (o *OctoPrint) Start(ctx context.Context, filename string) error {
+	body := map[string]interface{}{"command": "select", "print": true}
+	return o.request(ctx, "POST", "/api/files/local/"+url.PathEscape(filename), body, nil)
+}
+
+func (o *OctoPrint) Pause(ctx context.Context) error {
+	return o.request(ctx, "POST", "/api/job", map[string]string{"command": "pause", "action": "pause"}, nil)
+}
+
+func (o *OctoPrint) Resume(ctx context.Context) error {
+	return o.request(ctx, "POST", "/api/job", map[string]string{"command": "pause", "action": "resume"}, nil)
+}
+
+func (o *OctoPrint) Cancel(ctx context.Context) error {
+	return o.request(ctx, "POST", "/api/job", map[string]string{"command": "cancel"}, nil)
+}
+
+// OctoPrint has no emergency stop of its own, so M112 goes to the
+// firmware directly
+func (o *OctoPrint) EmergencyStop(ctx context.Context) error {
+	return o.sendCommands(ctx, "M112")
+}
+
+func (o *OctoPrint) DisplayMessage(ctx context.Context, GF GcodeFile) error {
+	return o.sendCommands(ctx, fmt.Sprintf("M117 %s %s %s", GF.Filename, GF.Color, GF.Material))
+}
+
+func (o *OctoPrint) DefaultDisplay(ctx context.Context) error {
+	return o.sendCommands(ctx, "M117")
+}
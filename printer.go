@@ -1,262 +1,533 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"mime/multipart"
-	"net/http"
-	"net/url"
-	"os"
-	"path/filepath"
-	"runtime"
-	"strings"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/firestore"
-	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
+// Print is the farm's handle on one printer: what it last printed and where
+// it stands in the print cycle. Talking to the machine is left to its
+// Printer driver
 type Print struct {
+	Id               string
 	Host             string
 	Port             string
-	ws               *websocket.Conn
+	driver           Printer
 	JobPath          string
 	LastUsedMaterial string
 	LastUsedColor    string
 	Status           int
-	IdleFlag         bool
-	done             chan struct{}
+	config           PrinterConfig
+	capabilities     Capabilities
+
+	// File being handled, if any, and how to withdraw it
+	currentFile *GcodeFile
+	withdraw    context.CancelFunc
+
+	// Why the printer is in Maintenance
+	maintenanceReason string
+	// Set when someone says the printer is ready again from afar, through
+	// ClearBed or Acknowledge, rather than at the machine
+	released bool
+	release  Signal
+
+	// Set once the printer has left the config. It takes no new files and
+	// is disconnected when done with the current one, retired from then on
+	draining bool
+	retired  bool
+	// Done once the printer is replaced by one with a new connection. Its
+	// print handler then lets go of the file, as on shutdown, and handlers
+	// tells when it has
+	replaced    context.Context
+	stopHandler context.CancelFunc
+	handlers    sync.WaitGroup
+	// Set on a replacement printer until it has taken over the print of
+	// the one it replaced, or found it isn't on it. It takes no files
+	// meanwhile
+	adopting bool
+	// Closed on the printer's next status update after it turned down a
+	// file at Start. It takes no files until then
+	sittingOut <-chan struct{}
+
+	// Time spent out of Standby, for utilization
+	created   time.Time
+	busySince time.Time
+	busy      time.Duration
+
+	// Guards Status, the LastUsed fields, the current file, maintenance,
+	// capabilities and draining, which the print handler and config
+	// reloads write while the scheduler reads them
+	mu sync.Mutex
 }
 
-func NewPrinter(host string, port string) *Print {
+func NewPrinter(cfg PrinterConfig) (*Print, error) {
+	driver, err := newDriver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newPrint(cfg, driver), nil
+}
+
+// Wraps a driver, connecting it
+func newPrint(cfg PrinterConfig, driver Printer) *Print {
 	p := new(Print)
-	p.Host = host
-	p.Port = port
+	p.Id = cfg.Id
+	p.Host = cfg.Host
+	p.Port = cfg.Port
+	p.driver = driver
+	p.config = cfg
+	p.capabilities = cfg.Capabilities
 	p.Status = Standby
-	p.IdleFlag = true
-	p.Connect()
-	p.StartReceiveThread()
+	p.created = time.Now()
+	p.replaced, p.stopHandler = context.WithCancel(context.Background())
+	p.driver.Connect()
 	return p
 }
 
-func (p *Print) Connect() {
-	u := url.URL{Scheme: "ws", Host: p.Host + ":" + p.Port, Path: "/websocket"}
-	log.Printf("connecting to %s", u.String())
-	var err error
-	p.ws, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatal("dial:", err)
-	}
-}
-
-func (p *Print) StartReceiveThread() {
-	done := make(chan struct{})
+// Runs a print handler on a context that is also done once the printer is
+// replaced
+func (p *Print) startHandler(ctx context.Context, handler func(ctx context.Context)) {
+	p.handlers.Add(1)
 	go func() {
-		defer close(done)
-		for {
-			_, message, err := p.ws.ReadMessage()
-			if err != nil {
-				log.Println("read:", err)
-				return
-			}
-			data, err := JsonUnmarshal(message)
-			if err != nil {
-				log.Print(err)
-				continue
+		defer p.handlers.Done()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-p.replaced.Done():
+				cancel()
+			case <-ctx.Done():
 			}
-			p.ProcessReceivedData(*data)
-		}
+		}()
+		handler(ctx)
 	}()
 }
 
-func (p *Print) ProcessReceivedData(data Jsonrpc) {
-	// Process data according to Id number
-	switch data.Id {
-	case IdPrintStatus:
-		result_object := data.Result.(Result_object)
-		p.Status = result_object.get_status_code()
-		return
-	}
-
-	// Process data according to method information
-	switch data.Method {
-	case "notify_proc_stat_update":
-		return
-	case "notify_gcode_response":
-		p.ProcessGcodeResponse(data.Params.([]interface{})[0].(string))
-		return
-	}
+// host:port identifying the printer in logs
+func (p *Print) Name() string {
+	return p.driver.Name()
+}
 
-	// Print all unprocessed data
-	data.Print_jsonrpc_data()
+func (p *Print) log() *logrus.Entry {
+	return printerLog(p.Name())
 }
 
-func (p *Print) ProcessGcodeResponse(res string) {
-	if strings.Contains(res, "IdleFlag:1.0") {
-		p.IdleFlag = true
-	} else if strings.Contains(res, "IdleFlag:0.0") {
-		p.IdleFlag = false
-	}
+// Closes the session with the printer. Whatever it is printing carries on
+func (p *Print) Close() {
+	p.driver.Close()
 }
 
-func (p *Print) SendJsonrpc(data Jsonrpc) {
-	err := p.ws.WriteJSON(data)
-	if err != nil {
-		log.Println("write:", err)
-		return
-	}
+func (p *Print) Online() bool {
+	return p.driver.ConnState() == ConnOnline
 }
 
-func (p *Print) SetDisplayNotification(GF GcodeFile) {
-	Script := "DISPLAY_NOTIFICATION "
-	Script += `NAME="` + GF.Filename + `"`
-	Script += ` COLOR="` + GF.Color + `"`
-	Script += ` MATERIAL="` + GF.Material + `"`
-	p.RequestGcodeScript(IdDisplayNotification, Script)
+func (p *Print) Capabilities() Capabilities {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.capabilities
 }
 
-func (p *Print) SetDefaultDisplay() {
-	p.RequestGcodeScript(IdDefaultDisplay, "DISPLAY_DEFAULT")
+func (p *Print) setCapabilities(c Capabilities) {
+	p.mu.Lock()
+	p.capabilities = c
+	p.mu.Unlock()
+	printerUpdates.Notify()
 }
 
-func (p *Print) RequestGcodeScript(Id int, Script string) {
-	Jsonrpc_req := NewJsonrpc()
-	Jsonrpc_req.Add_method("printer.gcode.script")
-	Jsonrpc_req.Add_id(Id)
-	Jsonrpc_req.Add_params_script(Script)
-	p.SendJsonrpc(Jsonrpc_req)
+// Returns a snapshot of the printer status reported by the driver
+func (p *Print) PrinterStatus() PrinterStatus {
+	return p.driver.Status()
 }
 
-func (p *Print) RequestPrintStatus() {
-	Jsonrpc_req := NewJsonrpc()
-	Jsonrpc_req.Add_method("printer.objects.query")
-	Jsonrpc_req.Add_id(IdPrintStatus)
-	Jsonrpc_req.Adds_params_objects()
-	p.SendJsonrpc(Jsonrpc_req)
+// Returns a channel that is closed on the next status change
+func (p *Print) StatusChanged() <-chan struct{} {
+	return p.driver.StatusChanged()
 }
 
-func (p *Print) StartFilenamePrint(FileName string) {
-	Jsonrpc_req := NewJsonrpc()
-	Jsonrpc_req.Add_method("printer.print.start")
-	Jsonrpc_req.Add_id(IdStartFileNamePrint)
-	Jsonrpc_req.Add_params_filename(FileName)
-	p.SendJsonrpc(Jsonrpc_req)
+func (p *Print) SetStatus(status uint) {
+	p.mu.Lock()
+	p.setStatusLocked(int(status))
+	p.mu.Unlock()
+	printerUpdates.Notify()
 }
 
-func (p *Print) UploadFile(GF GcodeFile) {
-	url := url.URL{Scheme: "http", Host: p.Host + ":" + p.Port, Path: "/server/files/upload"}
-	payload := &bytes.Buffer{}
-	writer := multipart.NewWriter(payload)
-	file, errFile1 := os.Open(fmt.Sprintf("C:/Models/Processed Orders/Order #%s - First Last/Upload-Gcode/%s", GF.JobId, GF.Filename))
-	defer file.Close()
-	part1, errFile1 := writer.CreateFormFile("file", filepath.Base(fmt.Sprintf("C:/Models/Processed Orders/Order #%s - First Last/Upload-Gcode/%s", GF.JobId, GF.Filename)))
-	_, errFile1 = io.Copy(part1, file)
-	if errFile1 != nil {
-		fmt.Println(errFile1)
-		return
+func (p *Print) setStatusLocked(status int) {
+	now := time.Now()
+	if p.Status == Standby && status != Standby {
+		p.busySince = now
+	} else if p.Status != Standby && status == Standby {
+		p.busy += now.Sub(p.busySince)
 	}
-	err := writer.Close()
-	if err != nil {
-		fmt.Println(err)
-		return
+	p.Status = status
+	if p.Status == Resetting || p.Status == Maintenance {
+		p.released = false
 	}
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url.String(), payload)
+// Moves the printer to Setup for a new file, unless it is draining or
+// still taking over a print
+func (p *Print) claim() bool {
+	p.mu.Lock()
+	if p.draining || p.adopting {
+		p.mu.Unlock()
+		return false
+	}
+	p.setStatusLocked(Setup)
+	p.mu.Unlock()
+	printerUpdates.Notify()
+	return true
+}
 
-	if err != nil {
-		fmt.Println(err)
-		return
+// Keeps the printer out of scheduling until its next status update, after
+// it turned down a file
+func (p *Print) sitOut() {
+	changed := p.StatusChanged()
+	p.mu.Lock()
+	p.sittingOut = changed
+	p.mu.Unlock()
+}
+
+// Whether the printer is still kept out by sitOut
+func (p *Print) SittingOut() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sittingOut == nil {
+		return false
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	res, err := client.Do(req)
-	if err != nil {
-		fmt.Println(err)
-		return
+	select {
+	case <-p.sittingOut:
+		p.sittingOut = nil
+		return false
+	default:
+		return true
 	}
-	defer res.Body.Close()
+}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		fmt.Println(err)
-		return
+// The file the printer is handling, if any
+func (p *Print) CurrentFile() (GcodeFile, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.currentFile == nil {
+		return GcodeFile{}, false
 	}
-	fmt.Println(string(body))
+	return *p.currentFile, true
 }
 
-func (p *Print) SetStatus(status uint) {
-	p.Status = int(status)
+func (p *Print) setCurrentFile(GF *GcodeFile, withdraw context.CancelFunc) {
+	p.mu.Lock()
+	p.currentFile = GF
+	p.withdraw = withdraw
+	p.mu.Unlock()
+}
+
+// Lets go of GF once the printer is done with it
+func (p *Print) finishFile(GF GcodeFile) {
+	farm.ReleaseGcode(GF, p)
+	p.setCurrentFile(nil, nil)
+}
+
+// Stops the printer working on GF: a print that has started is canceled,
+// one still being set up is abandoned. Reports false if the printer isn't
+// handling GF
+func (p *Print) Withdraw(GF GcodeFile) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.currentFile == nil || p.currentFile.Key() != GF.Key() {
+		return false
+	}
+	p.withdraw()
+	return true
+}
+
+// Gives the printer back after its file was withdrawn before printing
+func (p *Print) abandon(GF GcodeFile, ctx context.Context, store JobStore) {
+	GF.SetStatus(GcodeCanceled)
+	UpdateFileStatus(GF, ctx, store)
+	p.SetStatus(Standby)
+}
+
+// Share of time since the printer was added that it has spent out of
+// Standby
+func (p *Print) Utilization() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	busy := p.busy
+	if p.Status != Standby {
+		busy += now.Sub(p.busySince)
+	}
+	total := now.Sub(p.created)
+	if total <= 0 {
+		return 0
+	}
+	return float64(busy) / float64(total)
 }
 
 func (p *Print) GetStatus() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.Status
 }
 
+// Filament color and material of the last file sent to the printer
+func (p *Print) LastUsed() (color string, material string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.LastUsedColor, p.LastUsedMaterial
+}
+
+func (p *Print) SetLastUsed(color string, material string) {
+	p.mu.Lock()
+	p.LastUsedColor = color
+	p.LastUsedMaterial = material
+	p.mu.Unlock()
+}
+
 func (p *Print) GetIdleFlag() bool {
-	return p.IdleFlag
+	return p.PrinterStatus().IdleFlag
+}
+
+// Blocks until the IdleFlag reported by the printer display equals idle
+func (p *Print) waitForIdleFlag(ctx context.Context, idle bool) error {
+	for {
+		wait := p.StatusChanged()
+		if p.GetIdleFlag() == idle {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Blocks until the bed is cleared after a print, at the printer display or
+// through ClearBed
+func (p *Print) waitForBedCleared(ctx context.Context) error {
+	return p.waitForRelease(ctx, func(status PrinterStatus) bool { return status.IdleFlag })
+}
+
+// Blocks until the printer reports ready or someone releases it
+func (p *Print) waitForRelease(ctx context.Context, ready func(PrinterStatus) bool) error {
+	for {
+		release := p.release.Wait()
+		changed := p.StatusChanged()
+		p.mu.Lock()
+		released := p.released
+		p.mu.Unlock()
+		if released || ready(p.PrinterStatus()) {
+			return nil
+		}
+		select {
+		case <-release:
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Releases a printer waiting in the given status
+func (p *Print) releaseFrom(status int, notWaiting error) error {
+	p.mu.Lock()
+	if p.Status != status {
+		p.mu.Unlock()
+		return notWaiting
+	}
+	p.released = true
+	p.mu.Unlock()
+	p.release.Notify()
+	return nil
+}
+
+var ErrBedNotWaiting = errors.New("printer is not waiting for its bed to be cleared")
+
+// Marks the bed cleared for a printer waiting on it after a print
+func (p *Print) ClearBed() error {
+	return p.releaseFrom(Resetting, ErrBedNotWaiting)
 }
 
 // pass off gcode file for printer to handle
-func (p *Print) HandlePrintRequest(GF GcodeFile, ctx context.Context, client *firestore.Client) {
+func (p *Print) HandlePrintRequest(GF GcodeFile, ctx context.Context, store JobStore) {
 
 	p.SetStatus(Setup)
-	p.LastUsedColor = GF.Color
-	p.LastUsedMaterial = GF.Material
-	p.UploadFile(GF)
-	p.SetDisplayNotification(GF)
-	// If printer is idle, GetIdleFlag==True, stay in for loop
-	for p.GetIdleFlag() {
-		time.Sleep(time.Second)
+	p.SetLastUsed(GF.Color, GF.Material)
+
+	// Setup runs under its own context so that withdrawing the file
+	// abandons it part way
+	setupCtx, withdraw := context.WithCancel(ctx)
+	defer withdraw()
+	p.setCurrentFile(&GF, withdraw)
+	defer p.finishFile(GF)
+	withdrawn := func() bool {
+		return ctx.Err() == nil && setupCtx.Err() != nil
 	}
 
-	p.StartFilenamePrint(GF.Filename)
-	// Check on the print status
-	for range time.Tick(time.Second * 30) {
-		p.RequestPrintStatus()
-		printStatus := p.Status
-
-		if printStatus == Completed {
-
-			p.SetStatus(Resetting)
-			GF.SetStatus(GcodePrintSuccess)
-			UpdateFileStatus(GF, ctx, client)
-			// Wait until technician removes print, reset printer status to standby
-			// Send notification to release printer back to the queue
-			//-----------------------------------------------------------------------------
-			/* While printing, GetIdleFlag evaluates to false.
-			When technician is ready, LCD status is changed to Idle and
-			GetIdleFlag evaluates to true
-			*/
-			for p.GetIdleFlag() == false {
-				time.Sleep(time.Second)
-			}
-			p.SetStatus(Standby)
-			runtime.Goexit()
-
-		} else if printStatus == Paused {
+	if err := p.driver.WaitOnline(setupCtx); err != nil {
+		if withdrawn() {
+			p.abandon(GF, ctx, store)
+			return
+		}
+		p.log().WithFields(fileFields(GF)).Error("wait for printer: ", err)
+		return
+	}
+	if err := p.driver.Upload(setupCtx, GF); err != nil {
+		if withdrawn() {
+			p.abandon(GF, ctx, store)
+			return
+		}
+		// Shutting down or replaced; whoever takes over sorts it out
+		if ctx.Err() != nil {
+			return
+		}
+		// Without the file there is nothing to print; flag it on the job
+		// and give the printer back
+		GF.SetStatusMessage(GcodeError, fmt.Sprintf("upload to %s failed: %v", p.Name(), err))
+		UpdateFileStatus(GF, ctx, store)
+		p.SetStatus(Standby)
+		return
+	}
+	if err := p.driver.DisplayMessage(setupCtx, GF); err != nil {
+		p.log().WithFields(fileFields(GF)).Warn("display notification: ", err)
+	}
+	// If printer is idle, GetIdleFlag==True, wait for it to drop
+	if err := p.waitForIdleFlag(setupCtx, false); err != nil {
+		if withdrawn() {
+			p.abandon(GF, ctx, store)
+		}
+		return
+	}
+	if withdrawn() {
+		p.abandon(GF, ctx, store)
+		return
+	}
 
-			fmt.Println("Paused")
+	before := p.PrinterStatus()
+	if err := p.driver.Start(ctx, GF.Filename); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		// Turned down, busy or cut off, which says nothing about the file.
+		// It goes back in the queue without using up an attempt, and the
+		// printer sits out until it reports in again
+		p.log().WithFields(fileFields(GF)).Warn("start print: ", err)
+		p.finishFile(GF)
+		GF.SetStatusMessage(GcodeIdle, fmt.Sprintf("printer %s didn't start it: %v", p.Id, err))
+		p.sitOut()
+		p.SetStatus(Standby)
+		UpdateFileStatus(GF, ctx, store)
+		return
+	}
+	p.followPrint(GF, &before, setupCtx, ctx, store)
+}
 
-		} else if printStatus == Canceled {
+// Picks up a print that was already running when farm-node started and
+// sees it through like one it had started itself
+func (p *Print) AdoptPrint(GF GcodeFile, ctx context.Context, store JobStore) {
+	p.SetStatus(Printing)
+	p.SetLastUsed(GF.Color, GF.Material)
 
-			p.SetStatus(Resetting)
-			GF.SetStatus(GcodeCanceled)
-			UpdateFileStatus(GF, ctx, client)
-			// Send notification to release printer back to the queue
-			for p.GetIdleFlag() == false {
-				time.Sleep(time.Second)
-			}
-			p.SetStatus(Standby)
-			runtime.Goexit()
+	withdrawCtx, withdraw := context.WithCancel(ctx)
+	defer withdraw()
+	p.setCurrentFile(&GF, withdraw)
+	defer p.finishFile(GF)
 
-		} else if printStatus == E {
+	p.followPrint(GF, nil, withdrawCtx, ctx, store)
+}
 
-			fmt.Println("Error!")
+// React to the print status as updates arrive, until the print is over and
+// the printer cleared. A dropped connection just means no updates for a
+// while; the print keeps running on the printer and the subscription picks
+// it up again after reconnect. before is the status from just before GF
+// was started, nil when the printer is known to be on GF already
+func (p *Print) followPrint(GF GcodeFile, before *PrinterStatus, withdrawCtx context.Context, ctx context.Context, store JobStore) {
+	started := before == nil
+	lastState := -1
+	withdrawWait := withdrawCtx.Done()
+	for {
+		wait := p.StatusChanged()
+		status := p.PrinterStatus()
+
+		// Until our file shows up, print_stats still describes whatever
+		// ran before it. A print that ends quickly may never be seen
+		// printing, so any change on our file is ours
+		if !started {
+			changed := status.State != before.State || status.Filename != before.Filename || status.Message != before.Message
+			started = status.Filename == GF.Filename && status.State != -1 &&
+				(status.State == Printing || changed)
+		}
+		printStatus := status.State
+
+		if started && printStatus != lastState {
+			resumed := lastState == Paused
+			lastState = printStatus
+			switch printStatus {
+			case Completed:
+				p.SetStatus(Resetting)
+				GF.SetStatus(GcodePrintSuccess)
+				UpdateFileStatus(GF, ctx, store)
+				// Wait until technician removes print, reset printer status to standby
+				// Send notification to release printer back to the queue
+				//-----------------------------------------------------------------------------
+				/* While printing, GetIdleFlag evaluates to false.
+				When technician is ready, LCD status is changed to Idle and
+				GetIdleFlag evaluates to true
+				*/
+				if err := p.waitForBedCleared(ctx); err != nil {
+					return
+				}
+				p.SetStatus(Standby)
+				return
+			case Printing:
+				p.SetStatus(Printing)
+				if resumed {
+					GF.SetStatus(GcodePrinting)
+					UpdateFileStatus(GF, ctx, store)
+				}
+			case Paused:
+				p.SetStatus(Paused)
+				GF.SetStatus(GcodePaused)
+				UpdateFileStatus(GF, ctx, store)
+			case Canceled:
+				p.SetStatus(Resetting)
+				GF.SetStatus(GcodeCanceled)
+				UpdateFileStatus(GF, ctx, store)
+				// Send notification to release printer back to the queue
+				if err := p.waitForBedCleared(ctx); err != nil {
+					return
+				}
+				p.SetStatus(Standby)
+				return
+			case E:
+				p.fail(GF, status, ctx, store)
+				return
+			}
+		}
 
+		select {
+		case <-wait:
+		case <-withdrawWait:
+			if ctx.Err() != nil {
+				return
+			}
+			// Cancel on the printer; the Canceled state that follows
+			// records it and releases the printer as usual
+			withdrawWait = nil
+			if err := p.driver.Cancel(ctx); err != nil {
+				p.log().WithFields(fileFields(GF)).Error("cancel print: ", err)
+			}
+			if !started {
+				p.abandon(GF, ctx, store)
+				return
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Bounds for the delay between reconnect attempts
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = time.Minute
+)
+
+// Websocket connection states
+const (
+	ConnConnecting = 0
+	ConnOnline     = 1
+	ConnOffline    = 2
+)
+
+var ErrDisconnected = errors.New("printer disconnected")
+
+// Printer is the driver for one machine in the farm. Each implementation
+// talks to a different kind of print server; Print holds the farm side of
+// things and only ever goes through this interface
+type Printer interface {
+	// host:port identifying the printer in logs
+	Name() string
+	// Starts keeping a session to the printer open in the background,
+	// reconnecting as needed until Close
+	Connect()
+	Close()
+	ConnState() int
+	// Blocks until the printer is online or ctx is done
+	WaitOnline(ctx context.Context) error
+
+	// Sends a G-code file to the printer's storage
+	Upload(ctx context.Context, GF GcodeFile) error
+	// Starts printing a previously uploaded file
+	Start(ctx context.Context, filename string) error
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+	Cancel(ctx context.Context) error
+	// Halts the printer at once, heaters and motors off. It stays halted
+	// until restarted at the machine
+	EmergencyStop(ctx context.Context) error
+
+	// Asks the printer directly which file it has loaded and its print
+	// state, without relying on the status subscription
+	QueryPrint(ctx context.Context) (filename string, state int, err error)
+
+	// Latest known status of the printer
+	Status() PrinterStatus
+	// Returns a channel that is closed on the next status change
+	StatusChanged() <-chan struct{}
+
+	// Shows which file is up next on the printer display
+	DisplayMessage(ctx context.Context, GF GcodeFile) error
+	// Puts the printer display back to its default screen
+	DefaultDisplay(ctx context.Context) error
+}
+
+// Creates the driver named by the printer's config block
+func newDriver(cfg PrinterConfig) (Printer, error) {
+	switch cfg.Driver {
+	case "", "moonraker":
+		return NewMoonraker(cfg.Host, cfg.Port), nil
+	case "octoprint":
+		return NewOctoPrint(cfg.Host, cfg.Port, cfg.ApiKey), nil
+	default:
+		return nil, fmt.Errorf("printers.%s: unknown driver %q", cfg.Id, cfg.Driver)
+	}
+}
+
+// Connection state and change notification shared by the drivers
+type driverBase struct {
+	connMu    sync.Mutex
+	connState int
+	connected Signal
+	changed   Signal
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	uploadMu sync.Mutex
+	upload   *UploadProgress
+}
+
+func newDriverBase() driverBase {
+	return driverBase{connState: ConnConnecting, closed: make(chan struct{})}
+}
+
+func (d *driverBase) setConnState(state int) {
+	d.connMu.Lock()
+	d.connState = state
+	d.connMu.Unlock()
+	d.connected.Notify()
+	printerUpdates.Notify()
+}
+
+func (d *driverBase) ConnState() int {
+	d.connMu.Lock()
+	defer d.connMu.Unlock()
+	return d.connState
+}
+
+func (d *driverBase) Online() bool {
+	return d.ConnState() == ConnOnline
+}
+
+func (d *driverBase) WaitOnline(ctx context.Context) error {
+	for {
+		wait := d.connected.Wait()
+		if d.Online() {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-d.closed:
+			return ErrDisconnected
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (d *driverBase) StatusChanged() <-chan struct{} {
+	return d.changed.Wait()
+}
+
+func (d *driverBase) notifyStatusChanged() {
+	d.changed.Notify()
+	printerUpdates.Notify()
+}
+
+// Records progress of the running upload; nil once it is over
+func (d *driverBase) setUpload(progress *UploadProgress) {
+	d.uploadMu.Lock()
+	d.upload = progress
+	d.uploadMu.Unlock()
+	d.notifyStatusChanged()
+}
+
+// Returns a copy of the running upload's progress, or nil
+func (d *driverBase) uploadProgress() *UploadProgress {
+	d.uploadMu.Lock()
+	defer d.uploadMu.Unlock()
+	if d.upload == nil {
+		return nil
+	}
+	progress := *d.upload
+	return &progress
+}
+
+// Marks the driver closed; reports whether this call did it
+func (d *driverBase) markClosed() bool {
+	first := false
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		first = true
+	})
+	return first
+}
+
+// Returns a context that is canceled once the driver is closed
+func (d *driverBase) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-d.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (d *driverBase) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sleeps before the next reconnect attempt. Returns false if the driver
+// was closed in the meantime
+func (d *driverBase) sleep(delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-d.closed:
+		return false
+	}
+}
+
+// Delay before reconnect attempt n: doubles from the base delay up to the
+// maximum, with jitter so a rebooted farm doesn't redial in lockstep
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = reconnectBaseDelay << uint(attempt)
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/mitchellh/mapstructure"
+)
+
+// Printer objects subscribed to on every new session
+var subscribedObjects = []string{
+	"print_stats",
+	"virtual_sdcard",
+	"webhooks",
+	"extruder",
+	"heater_bed",
+	"display_status",
+}
+
+// Snapshot of the subscribed printer objects
+type PrinterStatus struct {
+	State          int     // print_stats.state as a status code
+	Filename       string  // print_stats.filename
+	Message        string  // print_stats.message
+	Progress       float64 // virtual_sdcard.progress, 0 to 1
+	KlippyState    string  // webhooks.state
+	StateMessage   string  // webhooks.state_message
+	DisplayMessage string  // display_status.message
+	HotendTemp     float64
+	HotendTarget   float64
+	BedTemp        float64
+	BedTarget      float64
+	IdleFlag       bool
+	Upload         *UploadProgress // nil unless a file is being sent
+}
+
+// Builds the typed snapshot from the raw object cache
+func newPrinterStatus(objects map[string]map[string]interface{}, idle bool) PrinterStatus {
+	var ps Print_stats_object
+	var vsd Virtual_sdcard_object
+	var wh Webhooks_object
+	var extruder, bed Heater_object
+	var display Display_status_object
+	mapstructure.Decode(objects["print_stats"], &ps)
+	mapstructure.Decode(objects["virtual_sdcard"], &vsd)
+	mapstructure.Decode(objects["webhooks"], &wh)
+	mapstructure.Decode(objects["extruder"], &extruder)
+	mapstructure.Decode(objects["heater_bed"], &bed)
+	mapstructure.Decode(objects["display_status"], &display)
+
+	return PrinterStatus{
+		State:          status_code(ps.State),
+		Filename:       ps.Filename,
+		Message:        ps.Message,
+		Progress:       float64(vsd.Progress),
+		KlippyState:    wh.State,
+		StateMessage:   wh.State_message,
+		DisplayMessage: display.Message,
+		HotendTemp:     extruder.Temperature,
+		HotendTarget:   extruder.Target,
+		BedTemp:        bed.Temperature,
+		BedTarget:      bed.Target,
+		IdleFlag:       idle,
+	}
+}
+
+// Folds a status delta into the object cache. Moonraker only sends the
+// fields that changed, so each object is merged field by field
+func mergeStatus(objects map[string]map[string]interface{}, delta map[string]interface{}) {
+	for name, v := range delta {
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		cached := objects[name]
+		if cached == nil {
+			cached = make(map[string]interface{})
+			objects[name] = cached
+		}
+		for k, field := range fields {
+			cached[k] = field
+		}
+	}
+}
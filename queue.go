@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// How the G-code queue is ordered
+type QueueOrder struct {
+	// "priority": highest priority first, a file gaining one level for
+	// every Aging it has waited. "deadline": earliest due date first,
+	// files without one being due DefaultDue after they were queued
+	Mode       string
+	Aging      time.Duration
+	DefaultDue time.Duration
+}
+
+func loadQueueOrder() (QueueOrder, error) {
+	order := QueueOrder{
+		Mode:       viper.GetString("queue.order"),
+		Aging:      time.Hour,
+		DefaultDue: 72 * time.Hour,
+	}
+	if order.Mode == "" {
+		order.Mode = "priority"
+	}
+	if order.Mode != "priority" && order.Mode != "deadline" {
+		return order, fmt.Errorf("queue.order: unknown order %q", order.Mode)
+	}
+	if viper.IsSet("queue.aging") {
+		order.Aging = viper.GetDuration("queue.aging")
+	}
+	if viper.IsSet("queue.default_due") {
+		order.DefaultDue = viper.GetDuration("queue.default_due")
+	}
+	return order, nil
+}
+
+// Priority with one level added per Aging waited, so low priority work
+// still reaches the front eventually
+func (o QueueOrder) effectivePriority(g GcodeFile, now time.Time) int {
+	if o.Aging <= 0 {
+		return g.Priority
+	}
+	return g.Priority + int(now.Sub(g.EnqueuedAt)/o.Aging)
+}
+
+func (o QueueOrder) deadline(g GcodeFile) time.Time {
+	if !g.DueAt.IsZero() {
+		return g.DueAt
+	}
+	return g.EnqueuedAt.Add(o.DefaultDue)
+}
+
+// Whether a should be printed before b
+func (o QueueOrder) less(a GcodeFile, b GcodeFile, now time.Time) bool {
+	if o.Mode == "deadline" {
+		if da, db := o.deadline(a), o.deadline(b); !da.Equal(db) {
+			return da.Before(db)
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+	} else {
+		if pa, pb := o.effectivePriority(a, now), o.effectivePriority(b, now); pa != pb {
+			return pa > pb
+		}
+		if da, db := a.DueAt, b.DueAt; !da.Equal(db) {
+			// Files with a due date go ahead of those without
+			return !da.IsZero() && (db.IsZero() || da.Before(db))
+		}
+	}
+	if !a.EnqueuedAt.Equal(b.EnqueuedAt) {
+		return a.EnqueuedAt.Before(b.EnqueuedAt)
+	}
+	return a.Key() < b.Key()
+}
+
+// GcodeQueue holds the files waiting for a printer. Aging moves files up
+// over time, so they are put in order against the current time when read
+type GcodeQueue struct {
+	order QueueOrder
+	files []GcodeFile
+}
+
+func NewGcodeQueue(order QueueOrder) *GcodeQueue {
+	return &GcodeQueue{order: order}
+}
+
+func (q *GcodeQueue) Len() int {
+	return len(q.files)
+}
+
+func (q *GcodeQueue) Add(gcode GcodeFile) {
+	q.files = append(q.files, gcode)
+}
+
+// Takes out the file with the given key; reports whether it was queued
+func (q *GcodeQueue) Remove(key string) bool {
+	for i := range q.files {
+		if q.files[i].Key() == key {
+			q.files = append(q.files[:i:i], q.files[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the queued file with the same key. It keeps its place in line
+// unless it comes with the stored time it was first queued. Reports false
+// if no such file is queued
+func (q *GcodeQueue) Update(gcode GcodeFile) bool {
+	for i := range q.files {
+		if q.files[i].Key() == gcode.Key() {
+			if gcode.EnqueuedAt.IsZero() {
+				gcode.EnqueuedAt = q.files[i].EnqueuedAt
+			}
+			q.files[i] = gcode
+			return true
+		}
+	}
+	return false
+}
+
+// Changes the ordering of what is queued from now on
+func (q *GcodeQueue) SetOrder(order QueueOrder) {
+	q.order = order
+}
+
+// Returns the queued files in print order as of now
+func (q *GcodeQueue) Sorted() []GcodeFile {
+	now := time.Now()
+	sorted := append([]GcodeFile(nil), q.files...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return q.order.less(sorted[i], sorted[j], now)
+	})
+	return sorted
+}
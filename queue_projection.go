@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// How often queue positions are recomputed when nothing else changes
+const queuePublishInterval = time.Minute
+
+// Where a queued file stands and when it is expected to start
+type QueueProjection struct {
+	File     GcodeFile
+	Position int // 1 is next in line
+	// Set when a free printer can take the file straight away. The
+	// projected start is then left zero rather than following the clock
+	StartsNow      bool
+	ProjectedStart time.Time
+}
+
+// Plays the queue forward over the printers: each file, in queue order,
+// goes to the capable printer that frees up first. Printers mid-print free
+// up once the rest of their current file is done. Printers that are
+// offline, draining or waiting on someone, for an acknowledge or a cleared
+// bed, can't be timed and are left out. Files no printer left can take
+// get no projected start
+func projectQueue(queue []GcodeFile, printers []*Print, now time.Time) []QueueProjection {
+	var usable []*Print
+	var freeAt []time.Time
+	for _, p := range printers {
+		if at, ok := freesUpAt(p, now); ok {
+			usable = append(usable, p)
+			freeAt = append(freeAt, at)
+		}
+	}
+
+	projections := make([]QueueProjection, len(queue))
+	for i, gcode := range queue {
+		projections[i] = QueueProjection{File: gcode, Position: i + 1}
+		best := -1
+		for j, p := range usable {
+			if !p.Capabilities().CanPrint(gcode) {
+				continue
+			}
+			if best < 0 || freeAt[j].Before(freeAt[best]) {
+				best = j
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		if freeAt[best].Equal(now) {
+			projections[i].StartsNow = true
+		} else {
+			projections[i].ProjectedStart = freeAt[best]
+		}
+		freeAt[best] = freeAt[best].Add(estimatedDuration(gcode))
+	}
+	return projections
+}
+
+// When the printer can next take a file: now if it is free, or once the
+// rest of its current file is done. Reports false when that can't be told
+func freesUpAt(p *Print, now time.Time) (time.Time, bool) {
+	if !p.Online() || p.Draining() || p.Adopting() {
+		return time.Time{}, false
+	}
+	current, printing := p.CurrentFile()
+	switch p.GetStatus() {
+	case Standby:
+		if !printing {
+			return now, true
+		}
+	case Setup, Printing:
+		if printing {
+			remaining := estimatedDuration(current)
+			remaining -= time.Duration(float64(remaining) * p.PrinterStatus().Progress)
+			return now.Add(remaining), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Keeps each queued file's position and projected start up to date on its
+// job document, so the storefront can show them. Only changes are written
+func publishQueue(ctx context.Context, store JobStore) {
+	published := make(map[string]QueueProjection)
+	ticker := time.NewTicker(queuePublishInterval)
+	defer ticker.Stop()
+
+	for {
+		wait := farm.QueueChanged()
+		projections := projectQueue(farm.Queue(), farm.Printers(), time.Now())
+
+		current := make(map[string]bool, len(projections))
+		for _, proj := range projections {
+			key := proj.File.Key()
+			current[key] = true
+			proj.ProjectedStart = proj.ProjectedStart.Truncate(time.Minute)
+			if last, ok := published[key]; ok && last.Position == proj.Position &&
+				last.StartsNow == proj.StartsNow && last.ProjectedStart.Equal(proj.ProjectedStart) {
+				continue
+			}
+			if err := store.UpdateQueueProjection(ctx, proj); err != nil {
+				logger.WithFields(fileFields(proj.File)).Error("queue projection not updated: ", err)
+				continue
+			}
+			published[key] = proj
+		}
+		// Files that left the queue no longer have a place in it
+		for key, last := range published {
+			if !current[key] {
+				if err := store.ClearQueueProjection(ctx, last.File); err != nil {
+					logger.WithFields(fileFields(last.File)).Error("queue projection not cleared: ", err)
+				}
+				delete(published, key)
+			}
+		}
+
+		select {
+		case <-wait:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
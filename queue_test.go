@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueOrderLess(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	priority := QueueOrder{Mode: "priority", Aging: time.Hour, DefaultDue: 72 * time.Hour}
+	deadline := QueueOrder{Mode: "deadline", Aging: time.Hour, DefaultDue: 72 * time.Hour}
+	file := func(job string, priority int, queued time.Duration, due time.Duration) GcodeFile {
+		g := GcodeFile{JobId: job, Priority: priority, EnqueuedAt: now.Add(-queued)}
+		if due != 0 {
+			g.DueAt = now.Add(due)
+		}
+		return g
+	}
+
+	tests := []struct {
+		name  string
+		order QueueOrder
+		a, b  GcodeFile
+	}{
+		{"higher priority first", priority,
+			file("a", 2, time.Minute, 0), file("b", 1, 30*time.Minute, 0)},
+		{"aging lifts an older file", priority,
+			file("a", 0, 3*time.Hour, 0), file("b", 2, time.Minute, 0)},
+		{"aging counts whole periods only", priority,
+			file("a", 1, time.Minute, 0), file("b", 0, 59*time.Minute, 0)},
+		{"no aging keeps priority as set", QueueOrder{Mode: "priority"},
+			file("a", 1, time.Minute, 0), file("b", 0, 48*time.Hour, 0)},
+		{"due date ahead of none", priority,
+			file("a", 0, time.Minute, 48*time.Hour), file("b", 0, 2*time.Minute, 0)},
+		{"earlier due date first", priority,
+			file("a", 0, time.Minute, time.Hour), file("b", 0, 2*time.Minute, 2*time.Hour)},
+		{"earlier queued on a tie", priority,
+			file("b", 0, 2*time.Minute, 0), file("a", 0, time.Minute, 0)},
+		{"key on a full tie", priority,
+			file("a", 0, time.Minute, 0), file("b", 0, time.Minute, 0)},
+		{"earlier deadline first", deadline,
+			file("a", 0, time.Minute, time.Hour), file("b", 5, time.Minute, 2*time.Hour)},
+		{"default due from when queued", deadline,
+			file("a", 0, 80*time.Hour, 0), file("b", 0, time.Minute, time.Hour)},
+		{"explicit due date ahead of a later default", deadline,
+			file("a", 0, time.Minute, 24*time.Hour), file("b", 0, time.Minute, 0)},
+		{"higher priority on the same deadline", deadline,
+			file("a", 1, 2*time.Minute, time.Hour), file("b", 0, time.Minute, time.Hour)},
+		{"deadline mode ignores aging", deadline,
+			file("a", 0, time.Minute, time.Hour), file("b", 0, 10*time.Hour, 2*time.Hour)},
+		{"earlier queued on the same deadline and priority", deadline,
+			file("b", 0, 2*time.Minute, time.Hour), file("a", 0, time.Minute, time.Hour)},
+	}
+	for _, tt := range tests {
+		if !tt.order.less(tt.a, tt.b, now) {
+			t.Errorf("%s: %s not before %s", tt.name, tt.a.JobId, tt.b.JobId)
+		}
+		if tt.order.less(tt.b, tt.a, now) {
+			t.Errorf("%s: %s before %s", tt.name, tt.b.JobId, tt.a.JobId)
+		}
+	}
+}
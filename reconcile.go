@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Brings the queue and running prints in line with the latest version of a
+// job document. Idle files are queued, or requeued if they were reset to
+// idle. Files that are canceled or gone from the job are withdrawn from the
+// queue and their prints stopped. A removed or canceled job withdraws all
+// of its files. A control command is carried out on the job's prints
+func reconcileJob(job Job, removed bool, ctx context.Context, store JobStore) {
+	canceled := removed || job.Status == JobCanceled
+	latest := make(map[string]GcodeFile, len(job.GcodeFiles))
+	for _, gcode := range job.GcodeFiles {
+		latest[gcode.Key()] = gcode
+	}
+
+	for _, gcode := range farm.QueuedForJob(job.JobId) {
+		current, ok := latest[gcode.Key()]
+		if ok && !canceled && current.Status == GcodeIdle {
+			continue
+		}
+		if !farm.RemoveGcode(gcode) {
+			continue
+		}
+		logger.WithFields(fileFields(gcode)).Info("withdrawn from queue")
+		// Record why a still idle file of a canceled job won't print
+		if ok && !removed && current.Status == GcodeIdle {
+			current.SetStatus(GcodeCanceled)
+			UpdateFileStatus(current, ctx, store)
+		}
+	}
+
+	for _, a := range farm.ActiveForJob(job.JobId) {
+		current, ok := latest[a.File.Key()]
+		if ok && !canceled && current.Status != GcodeCanceled {
+			continue
+		}
+		// A print that already ended only waits for the bed to be cleared
+		if ok && (current.Status == GcodePrintSuccess || current.Status == GcodeError) {
+			continue
+		}
+		if a.Printer.Withdraw(a.File) {
+			a.Printer.log().WithFields(fileFields(a.File)).Info("canceled")
+		}
+	}
+
+	if canceled {
+		return
+	}
+	// Controls can wait on the printer, so they don't hold up the snapshot
+	if job.Control != "" {
+		go controlJob(job, ctx, store)
+	}
+	for _, gcode := range job.GcodeFiles {
+		if gcode.Status != GcodeIdle {
+			continue
+		}
+		if gcode.EnqueuedAt.IsZero() {
+			gcode.EnqueuedAt = time.Now()
+			recordEnqueued(gcode, ctx, store)
+		}
+		farm.OfferGcode(gcode)
+	}
+}
+
+// Stores when a file was first queued. Should that fail it is queued all
+// the same, and tried again the next time its job changes
+func recordEnqueued(gcode GcodeFile, ctx context.Context, store JobStore) {
+	err := store.RecordEnqueued(ctx, gcode)
+	if err != nil && !errors.Is(err, ErrFileChanged) && !errors.Is(err, ErrShuttingDown) {
+		logger.WithFields(fileFields(gcode)).Error("enqueue time not recorded: ", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// The printer list last read from the config. Held while applying it, so
+// one reload is through before the next starts
+var printerConfigs struct {
+	sync.Mutex
+	configs []PrinterConfig
+}
+
+// Brings the printers in line with the [printers.N] blocks after the config
+// file changed. New printers are connected and edits to capabilities apply
+// in place. Removed printers are drained: they take no new files and are
+// disconnected once done with the current one. A printer whose driver,
+// host, port or API key changed is connected anew straight away, see
+// reconnectPrinter
+func reloadPrinters(ctx context.Context, store JobStore, configs []PrinterConfig) {
+	// Most likely read while the file was being written
+	if len(configs) == 0 {
+		logger.Warn("no printers in config, keeping the current ones")
+		return
+	}
+	printerConfigs.Lock()
+	defer printerConfigs.Unlock()
+	printerConfigs.configs = configs
+	farm.MarkPrintersChanged()
+	applyPrinterConfigs(ctx, store, configs)
+}
+
+func applyPrinterConfigs(ctx context.Context, store JobStore, configs []PrinterConfig) {
+	wanted := make(map[string]PrinterConfig, len(configs))
+	for _, cfg := range configs {
+		wanted[cfg.Id] = cfg
+	}
+
+	present := make(map[string]bool)
+	for _, p := range farm.Printers() {
+		present[p.Id] = true
+		cfg, ok := wanted[p.Id]
+		if !ok {
+			if p.drain() {
+				p.log().Info("left the config, draining")
+				go retire(ctx, store, p)
+			}
+			continue
+		}
+		if p.undrain() {
+			p.log().Info("back in the config")
+		}
+		if connectionChanged(p.config, cfg) {
+			reconnectPrinter(ctx, store, p, cfg)
+			continue
+		}
+		p.setCapabilities(cfg.Capabilities)
+	}
+
+	// A printer still draining under the same id is replaced once it is
+	// gone, when retire applies the config again
+	for _, cfg := range configs {
+		if present[cfg.Id] {
+			continue
+		}
+		p, err := NewPrinter(cfg)
+		if err != nil {
+			logger.WithField("printer_id", cfg.Id).Error(err)
+			continue
+		}
+		farm.AddPrinter(p)
+		printerUpdates.Notify()
+		p.log().Info("added")
+	}
+}
+
+// Whether the printer has to be reconnected to apply cfg
+func connectionChanged(old PrinterConfig, cfg PrinterConfig) bool {
+	return old.Driver != cfg.Driver || old.Host != cfg.Host || old.Port != cfg.Port || old.ApiKey != cfg.ApiKey
+}
+
+// Swaps a printer for a new one connected as cfg says, then disconnects
+// the old one. Its print handler lets go of the file without recording
+// anything, leaving it printing in the store. The new printer takes it over
+// as on startup: adopted if the machine is still on it, back in the queue
+// if not
+func reconnectPrinter(ctx context.Context, store JobStore, p *Print, cfg PrinterConfig) {
+	moved, err := NewPrinter(cfg)
+	if err != nil {
+		p.log().Error("not reconnected: ", err)
+		return
+	}
+	// Takes no files until it knows whether it is still on the old print
+	moved.adopting = true
+	if !farm.ReplacePrinter(p, moved) {
+		// Retired in the meantime, and replaced when it is gone
+		moved.Close()
+		return
+	}
+	// Retired before its files are read, so it can't claim another
+	p.retireReplaced()
+	files := farm.ActiveForPrinter(p)
+	p.stopHandler()
+	printerUpdates.Notify()
+	p.log().Info("reconnecting as ", moved.Name())
+
+	go func() {
+		defer moved.doneAdopting()
+		// Closed only once its handler is gone, which would otherwise see
+		// the connection drop before being told to stop
+		p.handlers.Wait()
+		p.Close()
+		// Only files still printing by the snapshot need taking over;
+		// any others the old printer was done with
+		var printing []GcodeFile
+		for _, gcode := range files {
+			job, ok := farm.Job(gcode.JobId)
+			if !ok || gcode.FileIndex >= len(job.GcodeFiles) {
+				continue
+			}
+			current := job.GcodeFiles[gcode.FileIndex]
+			if current.Status == GcodePrinting || current.Status == GcodePaused {
+				printing = append(printing, current)
+			}
+		}
+		if len(printing) > 0 {
+			reconcilePrints(ctx, store, []*Print{moved}, printing, "printer "+moved.Id+" was reconnected and isn't running it")
+		}
+	}()
+}
+
+// Waits for a draining printer to finish its file and be cleared, then
+// takes it out of the farm and disconnects it. Stops if the printer comes
+// back into the config in the meantime
+func retire(ctx context.Context, store JobStore, p *Print) {
+	for {
+		wait := printerUpdates.Wait()
+		retired, draining := p.retireIfIdle()
+		if retired {
+			break
+		}
+		if !draining {
+			return
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return
+		}
+	}
+	// Marked first, so whoever sees the printer gone sees the change too
+	farm.MarkPrintersChanged()
+	farm.RemovePrinter(p)
+	p.Close()
+	printerUpdates.Notify()
+	p.log().Info("removed")
+	// Connects the printer's replacement, if it was only moved
+	printerConfigs.Lock()
+	applyPrinterConfigs(ctx, store, printerConfigs.configs)
+	printerConfigs.Unlock()
+}
+
+func (p *Print) Draining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining
+}
+
+// Stops the printer taking new files. Reports false if it already was
+// draining
+func (p *Print) drain() bool {
+	p.mu.Lock()
+	started := !p.draining
+	p.draining = true
+	p.mu.Unlock()
+	printerUpdates.Notify()
+	return started
+}
+
+// Lets a draining printer take files again. Reports false if it wasn't
+// draining, or is too late to keep
+func (p *Print) undrain() bool {
+	p.mu.Lock()
+	resumed := p.draining && !p.retired
+	if resumed {
+		p.draining = false
+	}
+	p.mu.Unlock()
+	if resumed {
+		printerUpdates.Notify()
+	}
+	return resumed
+}
+
+// Retires a printer that was replaced, whatever it is doing
+func (p *Print) retireReplaced() {
+	p.mu.Lock()
+	p.draining = true
+	p.retired = true
+	p.mu.Unlock()
+}
+
+func (p *Print) Adopting() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.adopting
+}
+
+// Lets a replacement printer take files, once it has taken over or let go
+// of the print of the printer it replaced
+func (p *Print) doneAdopting() {
+	p.mu.Lock()
+	p.adopting = false
+	p.mu.Unlock()
+	printerUpdates.Notify()
+}
+
+// Marks a draining printer retired if it is done with its file and back in
+// Standby, which claim then can't change. Also reports whether it is still
+// draining
+func (p *Print) retireIfIdle() (retired bool, draining bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining && p.Status == Standby && p.currentFile == nil {
+		p.retired = true
+	}
+	return p.retired, p.draining
+}
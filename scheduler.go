@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Snapshot of one printer as the scheduler sees it
+type PrinterState struct {
+	Printer      *Print
+	Available    bool // online, in Standby between prints, not draining, adopting or sitting out
+	Color        string
+	Material     string
+	Capabilities Capabilities
+	Utilization  float64 // share of time spent busy, 0 to 1
+}
+
+// Whether the printer is free and able to print the file, and hasn't
+// already failed it
+func (ps PrinterState) CanTake(gcode GcodeFile) bool {
+	return ps.Available && ps.Capabilities.CanPrint(gcode) && !gcode.FailedOnPrinter(ps.Printer.Id)
+}
+
+// A queued file handed to a printer
+type Assignment struct {
+	Printer *Print
+	File    GcodeFile
+}
+
+// Scheduler decides which queued files go to which available printers.
+// It only plans; managePrintJobs carries the assignments out
+type Scheduler interface {
+	Assign(queue []GcodeFile, printers []PrinterState) []Assignment
+}
+
+// Builds the scheduler named by scheduler.policy
+func newScheduler() (Scheduler, error) {
+	switch policy := viper.GetString("scheduler.policy"); policy {
+	case "", "weighted":
+		return &WeightedScheduler{Weights: loadSchedulerWeights()}, nil
+	case "fifo":
+		return &FIFOScheduler{}, nil
+	default:
+		return nil, fmt.Errorf("scheduler.policy: unknown policy %q", policy)
+	}
+}
+
+// Captures the state of every printer for one scheduling pass
+func snapshotPrinters(printers []*Print) []PrinterState {
+	states := make([]PrinterState, 0, len(printers))
+	for _, p := range printers {
+		color, material := p.LastUsed()
+		state := p.PrinterStatus().State
+		states = append(states, PrinterState{
+			Printer: p,
+			Available: p.Online() && p.GetStatus() == Standby && !p.Draining() &&
+				!p.Adopting() && !p.SittingOut() && betweenPrints(state),
+			Color:        color,
+			Material:     material,
+			Capabilities: p.Capabilities(),
+			Utilization:  p.Utilization(),
+		})
+	}
+	return states
+}
+
+// Whether print_stats shows the printer between prints, including after
+// one that errored. Until its first status arrives the state is unknown,
+// and the printer may well be busy
+func betweenPrints(state int) bool {
+	return state == Standby || state == Completed || state == Canceled || state == E
+}
+
+// FIFOScheduler hands out files in queue order. Each goes to a printer
+// already loaded with its color and material if one is free, otherwise to
+// any free printer that can take it
+type FIFOScheduler struct{}
+
+func (s *FIFOScheduler) Assign(queue []GcodeFile, printers []PrinterState) []Assignment {
+	taken := make([]bool, len(printers))
+	var assignments []Assignment
+
+	pick := func(gcode GcodeFile, sameFilament bool) bool {
+		for i, ps := range printers {
+			if taken[i] || !ps.CanTake(gcode) {
+				continue
+			}
+			if sameFilament && (ps.Color != gcode.Color || ps.Material != gcode.Material) {
+				continue
+			}
+			taken[i] = true
+			assignments = append(assignments, Assignment{Printer: ps.Printer, File: gcode})
+			return true
+		}
+		return false
+	}
+
+	for _, gcode := range queue {
+		if !pick(gcode, true) {
+			pick(gcode, false)
+		}
+	}
+	return assignments
+}
+
+// Relative weights of the factors WeightedScheduler scores on
+type SchedulerWeights struct {
+	// Penalty for swapping filament: full for a new material, half for a
+	// new color of the same material
+	FilamentChange float64
+	// Reward for a snug fit, keeping big printers free for big parts
+	BedFit float64
+	// Penalty for printers that have been busy the most
+	Utilization float64
+	// Reward per hour a file has waited in the queue
+	JobAge float64
+	// Penalty per hour of estimated print time, favoring short files
+	Time float64
+	// Reward for being near the front of the queue, 1 for the first file
+	// down to 0 for the last
+	QueueOrder float64
+}
+
+func loadSchedulerWeights() SchedulerWeights {
+	weight := func(key string, fallback float64) float64 {
+		if viper.IsSet("scheduler.weights." + key) {
+			return viper.GetFloat64("scheduler.weights." + key)
+		}
+		return fallback
+	}
+	return SchedulerWeights{
+		FilamentChange: weight("filament_change", 10),
+		BedFit:         weight("bed_fit", 1),
+		Utilization:    weight("utilization", 2),
+		JobAge:         weight("job_age", 1),
+		Time:           weight("time", 0.5),
+		QueueOrder:     weight("queue_order", 5),
+	}
+}
+
+// WeightedScheduler scores every pairing of a queued file with a free
+// printer and greedily takes the best pairs first
+type WeightedScheduler struct {
+	Weights SchedulerWeights
+}
+
+func (s *WeightedScheduler) Assign(queue []GcodeFile, printers []PrinterState) []Assignment {
+	now := time.Now()
+	fileTaken := make([]bool, len(queue))
+	printerTaken := make([]bool, len(printers))
+	var assignments []Assignment
+
+	for {
+		bestScore := math.Inf(-1)
+		bestFile, bestPrinter := -1, -1
+		for f, gcode := range queue {
+			if fileTaken[f] {
+				continue
+			}
+			for p, ps := range printers {
+				if printerTaken[p] || !ps.CanTake(gcode) {
+					continue
+				}
+				score := s.score(gcode, ps, now)
+				score += s.Weights.QueueOrder * (1 - float64(f)/float64(len(queue)))
+				if score > bestScore {
+					bestScore, bestFile, bestPrinter = score, f, p
+				}
+			}
+		}
+		if bestFile < 0 {
+			return assignments
+		}
+		fileTaken[bestFile] = true
+		printerTaken[bestPrinter] = true
+		assignments = append(assignments, Assignment{Printer: printers[bestPrinter].Printer, File: queue[bestFile]})
+	}
+}
+
+func (s *WeightedScheduler) score(gcode GcodeFile, ps PrinterState, now time.Time) float64 {
+	w := s.Weights
+	score := -w.FilamentChange * filamentChangeCost(gcode, ps)
+	score += w.BedFit * bedFit(gcode, ps.Capabilities)
+	score -= w.Utilization * ps.Utilization
+	if !gcode.EnqueuedAt.IsZero() {
+		score += w.JobAge * now.Sub(gcode.EnqueuedAt).Hours()
+	}
+	score -= w.Time * estimatedDuration(gcode).Hours()
+	return score
+}
+
+// 0 when the printer already has the file's filament loaded, 0.5 for a
+// color change, 1 for a material change
+func filamentChangeCost(gcode GcodeFile, ps PrinterState) float64 {
+	switch {
+	case ps.Material != gcode.Material:
+		return 1
+	case ps.Color != gcode.Color:
+		return 0.5
+	default:
+		return 0
+	}
+}
+
+// Share of the build volume the part's bounding box takes up, 0 when the
+// printer's volume isn't known
+func bedFit(gcode GcodeFile, c Capabilities) float64 {
+	volume := c.BuildVolume
+	if volume == (MaxDim{}) {
+		volume = defaultBuildVolume()
+	}
+	space := volume.Length * volume.Width * volume.Height
+	if space <= 0 {
+		return 0
+	}
+	part := gcode.MaxDim.Length * gcode.MaxDim.Width * gcode.MaxDim.Height
+	return math.Min(part/space, 1)
+}
+
+// The file's estimated print time. GcodeFile.Time is in minutes
+func estimatedDuration(gcode GcodeFile) time.Duration {
+	return time.Duration(gcode.Time * float64(time.Minute))
+}
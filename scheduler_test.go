@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func printerState(id string, material string, color string, utilization float64) PrinterState {
+	return PrinterState{
+		Printer:     &Print{Id: id},
+		Available:   true,
+		Color:       color,
+		Material:    material,
+		Utilization: utilization,
+	}
+}
+
+func queuedFile(job string, material string, color string) GcodeFile {
+	return GcodeFile{
+		JobId:      job,
+		Time:       60,
+		Filament:   Filament{Color: color, Material: material},
+		MaxDim:     MaxDim{Height: 10, Length: 10, Width: 10},
+		EnqueuedAt: time.Now().Add(-time.Hour),
+	}
+}
+
+// Who got what, as printer id by job id
+func assigned(assignments []Assignment) map[string]string {
+	got := make(map[string]string, len(assignments))
+	for _, a := range assignments {
+		got[a.File.JobId] = a.Printer.Id
+	}
+	return got
+}
+
+func TestWeightedSchedulerPicksPrinter(t *testing.T) {
+	busy := printerState("busy", "PLA", "black", 0)
+	busy.Available = false
+	failed := queuedFile("job-1", "PLA", "black")
+	failed.FailedOn = []string{"0"}
+
+	tests := []struct {
+		name     string
+		file     GcodeFile
+		printers []PrinterState
+		want     string
+	}{
+		{"same filament over a material change", queuedFile("job-1", "PLA", "black"),
+			[]PrinterState{printerState("0", "PETG", "black", 0), printerState("1", "PLA", "black", 0)}, "1"},
+		{"same filament over a color change", queuedFile("job-1", "PLA", "black"),
+			[]PrinterState{printerState("0", "PLA", "white", 0), printerState("1", "PLA", "black", 0)}, "1"},
+		{"color change over a material change", queuedFile("job-1", "PLA", "black"),
+			[]PrinterState{printerState("0", "PETG", "black", 0), printerState("1", "PLA", "white", 0)}, "1"},
+		{"least busy on the same filament", queuedFile("job-1", "PLA", "black"),
+			[]PrinterState{printerState("0", "PLA", "black", 0.8), printerState("1", "PLA", "black", 0.1)}, "1"},
+		{"filament outweighs idle time", queuedFile("job-1", "PLA", "black"),
+			[]PrinterState{printerState("0", "PETG", "black", 0), printerState("1", "PLA", "black", 1)}, "1"},
+		{"unavailable printer skipped", queuedFile("job-1", "PLA", "black"),
+			[]PrinterState{busy, printerState("1", "PETG", "white", 1)}, "1"},
+		{"printer the file failed on skipped", failed,
+			[]PrinterState{printerState("0", "PLA", "black", 0), printerState("1", "PETG", "white", 1)}, "1"},
+	}
+	for _, tt := range tests {
+		s := &WeightedScheduler{Weights: loadSchedulerWeights()}
+		got := assigned(s.Assign([]GcodeFile{tt.file}, tt.printers))
+		if len(got) != 1 || got[tt.file.JobId] != tt.want {
+			t.Errorf("%s: assigned %v, want printer %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWeightedSchedulerPairsFilesWithPrinters(t *testing.T) {
+	s := &WeightedScheduler{Weights: loadSchedulerWeights()}
+	queue := []GcodeFile{queuedFile("job-1", "PLA", "black"), queuedFile("job-2", "PETG", "white")}
+	printers := []PrinterState{printerState("0", "PETG", "white", 0), printerState("1", "PLA", "black", 0)}
+	got := assigned(s.Assign(queue, printers))
+	if len(got) != 2 || got["job-1"] != "1" || got["job-2"] != "0" {
+		t.Errorf("assigned %v, want job-1 on 1 and job-2 on 0", got)
+	}
+
+	// With one printer and nothing else to tell them apart, the file
+	// ahead in the queue goes first
+	queue[1].Filament = queue[0].Filament
+	got = assigned(s.Assign(queue, []PrinterState{printerState("0", "PLA", "black", 0)}))
+	if len(got) != 1 || got["job-1"] != "0" {
+		t.Errorf("assigned %v, want job-1 on 0", got)
+	}
+}
+
+func TestFIFOScheduler(t *testing.T) {
+	tests := []struct {
+		name     string
+		queue    []GcodeFile
+		printers []PrinterState
+		want     map[string]string
+	}{
+		{"queue order when one printer is free",
+			[]GcodeFile{queuedFile("job-1", "PETG", "white"), queuedFile("job-2", "PLA", "black")},
+			[]PrinterState{printerState("0", "PLA", "black", 0)},
+			map[string]string{"job-1": "0"}},
+		{"same filament ahead of list order",
+			[]GcodeFile{queuedFile("job-1", "PLA", "black")},
+			[]PrinterState{printerState("0", "PETG", "white", 0), printerState("1", "PLA", "black", 0)},
+			map[string]string{"job-1": "1"}},
+		{"first free printer without a filament match",
+			[]GcodeFile{queuedFile("job-1", "PLA", "black")},
+			[]PrinterState{printerState("0", "PETG", "white", 0.9), printerState("1", "PLA", "white", 0)},
+			map[string]string{"job-1": "0"}},
+		{"earlier file takes the match first",
+			[]GcodeFile{queuedFile("job-1", "PLA", "black"), queuedFile("job-2", "PLA", "black")},
+			[]PrinterState{printerState("0", "PETG", "white", 0), printerState("1", "PLA", "black", 0)},
+			map[string]string{"job-1": "1", "job-2": "0"}},
+	}
+	for _, tt := range tests {
+		got := assigned((&FIFOScheduler{}).Assign(tt.queue, tt.printers))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: assigned %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for job, printer := range tt.want {
+			if got[job] != printer {
+				t.Errorf("%s: assigned %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// How long shutdown waits for the node's own work to stop, and again for
+// store writes under way to finish
+const shutdownTimeout = 10 * time.Second
+
+var ErrShuttingDown = errors.New("shutting down")
+
+// Winds the node down once the context its workers run on is done. The
+// scheduler stops taking new work and the snapshot listeners, API and
+// maintenance loops return; then printer sessions are closed and the store
+// once its writes are through. Prints running on the printers carry on,
+// and are adopted again on the next start
+func shutdown(workers *sync.WaitGroup, store JobStore) {
+	logger.Info("shutting down")
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		logger.Warn("shutting down without waiting for all workers")
+	}
+
+	// Print handlers may still be recording what they saw last
+	if err := store.Close(); err != nil {
+		logger.Error("closing store: ", err)
+	}
+	for _, p := range farm.Printers() {
+		p.Close()
+	}
+	logger.Info("shut down")
+	if printerFiles != nil {
+		printerFiles.Close()
+	}
+}
+
+// writeGate counts the store writes under way, so that shutdown can let
+// them finish while turning new ones away
+type writeGate struct {
+	mu      sync.Mutex
+	writes  int
+	closing bool
+	idle    Signal
+}
+
+// Admits a write unless the gate is closing
+func (g *writeGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing {
+		return false
+	}
+	g.writes++
+	return true
+}
+
+func (g *writeGate) leave() {
+	g.mu.Lock()
+	g.writes--
+	idle := g.writes == 0
+	g.mu.Unlock()
+	if idle {
+		g.idle.Notify()
+	}
+}
+
+// Turns new writes away and waits for those under way, or until ctx is done
+func (g *writeGate) close(ctx context.Context) error {
+	g.mu.Lock()
+	g.closing = true
+	for g.writes > 0 {
+		wait := g.idle.Wait()
+		g.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		g.mu.Lock()
+	}
+	g.mu.Unlock()
+	return nil
+}
+
+// Keeps ctx's values but not its cancellation, so a write that has started
+// is not cut off part way when the node shuts down
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
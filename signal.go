@@ -0,0 +1,31 @@
+package main
+
+import "sync"
+
+// Signal wakes every goroutine waiting on it each time Notify is called.
+// Waiters grab the channel from Wait before checking the condition they care
+// about, so a Notify between the check and the receive is never missed
+type Signal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// Returns a channel that is closed on the next Notify
+func (s *Signal) Wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+// Wakes everyone currently waiting
+func (s *Signal) Notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// How long startup waits for printers to say what they are printing
+const defaultStartupTimeout = 30 * time.Second
+
+// Matches what the printers are doing against the job records before any
+// work is handed out, so a restart neither loses running prints nor prints
+// a file twice. Prints of files recorded as printing or paused are adopted
+// and seen through as if farm-node had started them. Files recorded as
+// printing that no printer has are put back to idle, but only if every printer
+// answered, since one that didn't may still be running them
+func reconcileStartup(ctx context.Context, store JobStore) error {
+	jobs, err := store.ListJobs(ctx)
+	if err != nil {
+		return err
+	}
+	var printing []GcodeFile
+	for _, job := range jobs {
+		for _, gcode := range job.GcodeFiles {
+			if gcode.Status == GcodePrinting || gcode.Status == GcodePaused {
+				printing = append(printing, gcode)
+			}
+		}
+	}
+	reconcilePrints(ctx, store, farm.Printers(), printing, "no printer was running it after a restart")
+	return nil
+}
+
+// Asks the printers what they are on and adopts those of the files that
+// they are printing. The rest are put back to idle with message, if every
+// printer answered
+func reconcilePrints(ctx context.Context, store JobStore, printers []*Print, files []GcodeFile, message string) {
+	printing := make(map[string][]GcodeFile)
+	for _, gcode := range files {
+		printing[gcode.Filename] = append(printing[gcode.Filename], gcode)
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, currentSettings().PrinterTimeout)
+	defer cancel()
+
+	type report struct {
+		printer  *Print
+		filename string
+		state    int
+		err      error
+	}
+	reports := make(chan report, len(printers))
+	for _, p := range printers {
+		go func(p *Print) {
+			filename, state, err := p.driver.QueryPrint(queryCtx)
+			reports <- report{p, filename, state, err}
+		}(p)
+	}
+
+	everyoneAnswered := true
+	for range printers {
+		r := <-reports
+		if r.err != nil {
+			r.printer.log().Warn("did not report its print: ", r.err)
+			everyoneAnswered = false
+			continue
+		}
+		if r.filename == "" || r.state == Standby {
+			continue
+		}
+		candidates := printing[r.filename]
+		i := adoptionCandidate(candidates, r.printer.Id)
+		if i < 0 {
+			r.printer.log().Warnf("is on %s, which no job is printing", r.filename)
+			continue
+		}
+		gcode := candidates[i]
+		printing[r.filename] = append(candidates[:i:i], candidates[i+1:]...)
+
+		r.printer.log().WithFields(fileFields(gcode)).Info("adopted")
+		farm.AdoptGcode(gcode, r.printer)
+		r.printer.SetStatus(Printing)
+		printer := r.printer
+		printer.startHandler(ctx, func(ctx context.Context) { printer.AdoptPrint(gcode, ctx, store) })
+	}
+
+	for _, files := range printing {
+		for _, gcode := range files {
+			if !everyoneAnswered {
+				logger.WithFields(fileFields(gcode)).Warn("left as printing")
+				continue
+			}
+			gcode.SetStatusMessage(GcodeIdle, message)
+			UpdateFileStatus(gcode, ctx, store)
+		}
+	}
+}
+
+// Picks which of the files printing under a filename the printer is on:
+// the one recorded as printing on it, or else one not recorded on any
+// printer. Returns -1 if neither is there
+func adoptionCandidate(candidates []GcodeFile, printerId string) int {
+	unassigned := -1
+	for i, gcode := range candidates {
+		if gcode.PrinterId == printerId {
+			return i
+		}
+		if gcode.PrinterId == "" && unassigned < 0 {
+			unassigned = i
+		}
+	}
+	return unassigned
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// JobStore is where jobs live: Firestore when the farm is online, a local
+// database when it isn't. Everything farm-node reads or writes about jobs
+// goes through it
+type JobStore interface {
+	// Calls handle for every change to the jobs until ctx is done or the
+	// store fails. Every existing job is reported as added first
+	WatchJobs(ctx context.Context, handle func(JobChange)) error
+	// Reads every job once
+	ListJobs(ctx context.Context) ([]Job, error)
+	// Records a file's status, failing with ErrFileChanged if the stored
+	// file is no longer the one gcode describes or can't take the status
+	UpdateFileStatus(ctx context.Context, gcode GcodeFile) error
+	// Records gcode.EnqueuedAt as when the file was first queued, unless
+	// the stored file already has a time. Fails with ErrFileChanged if the
+	// stored file is no longer the one gcode describes
+	RecordEnqueued(ctx context.Context, gcode GcodeFile) error
+	// Moves a job whose files are all finished to the archive
+	ArchiveJob(ctx context.Context, jobId string) error
+	// Deletes jobs archived before cutoff
+	PruneArchive(ctx context.Context, cutoff time.Time) error
+	// Clears a job's control command once it has been carried out, unless
+	// it has been replaced by another in the meantime
+	ClearControl(ctx context.Context, jobId string, control string) error
+
+	// Records where a queued file stands, for the storefront
+	UpdateQueueProjection(ctx context.Context, proj QueueProjection) error
+	ClearQueueProjection(ctx context.Context, gcode GcodeFile) error
+
+	Close() error
+}
+
+const (
+	JobAdded = iota
+	JobModified
+	JobRemoved
+)
+
+// A new version of a job. A removed job carries its last version
+type JobChange struct {
+	Kind int
+	Job  Job
+}
+
+// The file at a job's file index is no longer in a state the update was
+// meant for
+var ErrFileChanged = errors.New("file changed")
+
+// The job isn't finished in the store, whatever the local copy says
+var errJobNotFinished = errors.New("job not finished")
+
+// Opens the store named by store.backend. The memory backend keeps nothing
+// across restarts and is meant for trying things out
+func newJobStore(ctx context.Context) (JobStore, error) {
+	store, err := openJobStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newMeteredStore(store), nil
+}
+
+func openJobStore(ctx context.Context) (JobStore, error) {
+	switch backend := viper.GetString("store.backend"); backend {
+	case "", "firestore":
+		client, err := FirebaseInstance(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return NewFirestoreStore(client), nil
+	case "bolt":
+		return OpenBoltStore(viper.GetString("store.path"), viper.GetString("store.orders"))
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("store.backend: unknown backend %q", backend)
+	}
+}
+
+// Checks a file update against what is stored at the file's index: it must
+// still be the same file, only a file that is waiting or paused can be
+// started and only a running file can be paused, so one canceled in the
+// meantime stays canceled
+func checkFileUpdate(gcode GcodeFile, found bool, filename string, status int) error {
+	if !found {
+		return fmt.Errorf("%w: job %s no longer has file index %d", ErrFileChanged, gcode.JobId, gcode.FileIndex)
+	}
+	if filename != gcode.Filename {
+		return fmt.Errorf("%w: job %s file index %d is now %q", ErrFileChanged, gcode.JobId, gcode.FileIndex, filename)
+	}
+	running := status == GcodePrinting || status == GcodePaused
+	if (gcode.Status == GcodePrinting && status != GcodeIdle && !running) ||
+		(gcode.Status == GcodePaused && !running) {
+		return fmt.Errorf("%w: job %s file index %d has status %d", ErrFileChanged, gcode.JobId, gcode.FileIndex, status)
+	}
+	return nil
+}
+
+// Copies gcode's status onto the stored file, along with the printer,
+// times and failed attempts that go with it
+func applyFileStatus(file *GcodeFile, gcode GcodeFile, now time.Time) {
+	file.Status = gcode.Status
+	file.Message = gcode.Message
+	file.Attempts = gcode.Attempts
+	file.FailedOn = gcode.FailedOn
+	switch gcode.Status {
+	case GcodeIdle:
+		file.StartedAt = time.Time{}
+		file.FinishedAt = time.Time{}
+		file.PrinterId = ""
+	case GcodePaused:
+	case GcodePrinting:
+		file.StartedAt = gcode.StartedAt
+		if file.StartedAt.IsZero() {
+			file.StartedAt = now
+		}
+		file.FinishedAt = time.Time{}
+		file.PrinterId = gcode.PrinterId
+	default:
+		file.FinishedAt = now
+		if gcode.PrinterId != "" {
+			file.PrinterId = gcode.PrinterId
+		}
+	}
+}
+
+// Update status for a single Gcode file in the store
+func UpdateFileStatus(gcode GcodeFile, ctx context.Context, store JobStore) error {
+	err := store.UpdateFileStatus(ctx, gcode)
+	if err != nil {
+		logger.WithFields(fileFields(gcode)).Error("status not updated: ", err)
+		return err
+	}
+	recordPrintResult(gcode)
+	logger.WithFields(fileFields(gcode)).Info("status updated to ", gcode.Status)
+	return nil
+}
+
+// jobsSnapshot keeps our local global jobs in sync with the store
+func jobsSnapshot(ctx context.Context, store JobStore) {
+	err := store.WatchJobs(ctx, func(change JobChange) {
+		orderDocument := change.Job
+
+		// Check each possible case of the changes that could occur
+		switch change.Kind {
+		case JobAdded:
+			// Document has been added to our array
+			jobLog(orderDocument.JobId).Info("job added")
+			// Append our current document in our array
+			farm.PutJob(orderDocument)
+			// Put the waiting Gcode files into gcodeQueue
+			reconcileJob(orderDocument, false, ctx, store)
+		case JobModified:
+			// Document has been modified
+			jobLog(orderDocument.JobId).Info("job modified")
+			// Modify that element in our local array, orderDocument = document that was just modified
+			farm.PutJob(orderDocument)
+			jobLog(orderDocument.JobId).Debugf("%+v", orderDocument)
+			// Bring the queue and running prints in line with it
+			reconcileJob(orderDocument, false, ctx, store)
+		case JobRemoved:
+			// Document has been removed
+			jobLog(orderDocument.JobId).Info("job removed")
+			// Remove the document from our local array
+			farm.RemoveJob(orderDocument.JobId)
+			// Withdraw its files and stop its prints
+			reconcileJob(orderDocument, true, ctx, store)
+		default:
+			jobLog(orderDocument.JobId).Warn("unknown job change")
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		logger.Error("watching jobs: ", err)
+	}
+}
+
+// check local jobs array, scanning for gcode statuses if all gcode statuses
+// are finished then move the job to the archive. Archived jobs older than
+// the retention period are deleted
+// keep looping
+func maintainJobStore(ctx context.Context, store JobStore) {
+	retention := viper.GetDuration("archive.retention")
+	interval := time.Minute * 1
+	if viper.IsSet("archive.interval") {
+		interval = viper.GetDuration("archive.interval")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		jobs := farm.Jobs()
+		for i := range jobs {
+			job := jobs[i]
+			if !jobFinished(job) {
+				continue
+			}
+			if err := store.ArchiveJob(ctx, job.JobId); err != nil {
+				jobLog(job.JobId).Error("not archived: ", err)
+				continue
+			}
+			jobLog(job.JobId).Info("archived")
+		}
+
+		if retention > 0 {
+			if err := store.PruneArchive(ctx, time.Now().Add(-retention)); err != nil {
+				logger.Error("pruning archived jobs: ", err)
+			}
+		}
+	}
+}
+
+// Whether every file of the job is finished
+func jobFinished(job Job) bool {
+	if len(job.GcodeFiles) == 0 {
+		return false
+	}
+	for _, gcodeFile := range job.GcodeFiles {
+		if !gcodeFile.Finished() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// How often the local store looks for new orders
+const boltPollInterval = 5 * time.Second
+
+var (
+	boltJobs      = []byte("jobs")
+	boltCompleted = []byte("completed_jobs")
+)
+
+// BoltStore keeps jobs in a local BoltDB file, so a farm without internet
+// access can run from a local order list. Jobs are stored as JSON under
+// their id, in a jobs and a completed_jobs bucket like the Firestore
+// collections. Orders are read from a JSON file holding a list of jobs,
+// each with an id; jobs whose id the store has already seen are skipped
+type BoltStore struct {
+	db     *bolt.DB
+	orders string
+
+	// Modification time of the order list when it was last read
+	ordersMu   sync.Mutex
+	ordersRead time.Time
+	// Signaled on every write, so watchers don't wait for the next poll
+	changed Signal
+}
+
+func OpenBoltStore(path string, orders string) (*BoltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("store.path: no database file given")
+	}
+	// Only one process can hold the file; fail rather than wait forever
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltJobs, boltCompleted} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db, orders: orders}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Adds jobs from the order list if it changed since it was last read
+func (s *BoltStore) importOrders() error {
+	if s.orders == "" {
+		return nil
+	}
+	s.ordersMu.Lock()
+	defer s.ordersMu.Unlock()
+	info, err := os.Stat(s.orders)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(s.ordersRead) {
+		return nil
+	}
+	data, err := os.ReadFile(s.orders)
+	if err != nil {
+		return err
+	}
+	var jobs []Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("%s: %w", s.orders, err)
+	}
+	s.ordersRead = info.ModTime()
+
+	added := 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, job := range jobs {
+			if job.JobId == "" {
+				logger.Warn(s.orders, " has a job without an id, skipping it")
+				continue
+			}
+			id := []byte(job.JobId)
+			if tx.Bucket(boltJobs).Get(id) != nil || tx.Bucket(boltCompleted).Get(id) != nil {
+				continue
+			}
+			if err := putJob(tx.Bucket(boltJobs), job); err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	if added > 0 {
+		logger.Infof("imported %d jobs from %s", added, s.orders)
+	}
+	return err
+}
+
+func putJob(bucket *bolt.Bucket, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(job.JobId), data)
+}
+
+func decodeJob(data []byte) (Job, error) {
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return job, err
+	}
+	job.fillFiles()
+	return job, nil
+}
+
+// Returns the encoded jobs of a bucket by id
+func (s *BoltStore) readBucket(name []byte) (map[string][]byte, error) {
+	jobs := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).ForEach(func(k, v []byte) error {
+			jobs[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// Compares the stored jobs against the last pass on every write and every
+// poll, reporting what changed
+func (s *BoltStore) WatchJobs(ctx context.Context, handle func(JobChange)) error {
+	ticker := time.NewTicker(boltPollInterval)
+	defer ticker.Stop()
+
+	seen := make(map[string][]byte)
+	for {
+		wait := s.changed.Wait()
+		if err := s.importOrders(); err != nil {
+			logger.Error("importing orders: ", err)
+		}
+		current, err := s.readBucket(boltJobs)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, 0, len(current))
+		for id := range current {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			last, ok := seen[id]
+			if ok && bytes.Equal(last, current[id]) {
+				continue
+			}
+			job, err := decodeJob(current[id])
+			if err != nil {
+				jobLog(id).Error(err)
+				continue
+			}
+			change := JobChange{Kind: JobAdded, Job: job}
+			if ok {
+				change.Kind = JobModified
+			}
+			handle(change)
+		}
+		for id, last := range seen {
+			if _, ok := current[id]; ok {
+				continue
+			}
+			if job, err := decodeJob(last); err == nil {
+				handle(JobChange{Kind: JobRemoved, Job: job})
+			}
+		}
+		seen = current
+
+		select {
+		case <-wait:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *BoltStore) ListJobs(ctx context.Context) ([]Job, error) {
+	if err := s.importOrders(); err != nil {
+		logger.Error("importing orders: ", err)
+	}
+	return s.listBucket(boltJobs)
+}
+
+// Reads every archived job once
+func (s *BoltStore) ListArchivedJobs() ([]Job, error) {
+	return s.listBucket(boltCompleted)
+}
+
+func (s *BoltStore) listBucket(name []byte) ([]Job, error) {
+	stored, err := s.readBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(stored))
+	for id, data := range stored {
+		job, err := decodeJob(data)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %w", id, err)
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].JobId < jobs[j].JobId })
+	return jobs, nil
+}
+
+func (s *BoltStore) UpdateFileStatus(ctx context.Context, gcode GcodeFile) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltJobs)
+		data := bucket.Get([]byte(gcode.JobId))
+		if data == nil {
+			return fmt.Errorf("job %s not found", gcode.JobId)
+		}
+		job, err := decodeJob(data)
+		if err != nil {
+			return err
+		}
+		found := gcode.FileIndex < len(job.GcodeFiles)
+		var file *GcodeFile
+		if found {
+			file = &job.GcodeFiles[gcode.FileIndex]
+		} else {
+			file = &GcodeFile{}
+		}
+		if err := checkFileUpdate(gcode, found, file.Filename, file.Status); err != nil {
+			return err
+		}
+
+		applyFileStatus(file, gcode, time.Now())
+		return putJob(bucket, job)
+	})
+	if err == nil {
+		s.changed.Notify()
+	}
+	return err
+}
+
+func (s *BoltStore) RecordEnqueued(ctx context.Context, gcode GcodeFile) error {
+	recorded := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltJobs)
+		data := bucket.Get([]byte(gcode.JobId))
+		if data == nil {
+			return fmt.Errorf("job %s not found", gcode.JobId)
+		}
+		job, err := decodeJob(data)
+		if err != nil {
+			return err
+		}
+		found := gcode.FileIndex < len(job.GcodeFiles)
+		var file *GcodeFile
+		if found {
+			file = &job.GcodeFiles[gcode.FileIndex]
+		} else {
+			file = &GcodeFile{}
+		}
+		if err := checkFileUpdate(gcode, found, file.Filename, file.Status); err != nil {
+			return err
+		}
+		if !file.EnqueuedAt.IsZero() {
+			return nil
+		}
+
+		file.EnqueuedAt = gcode.EnqueuedAt
+		recorded = true
+		return putJob(bucket, job)
+	})
+	if recorded && err == nil {
+		s.changed.Notify()
+	}
+	return err
+}
+
+func (s *BoltStore) ArchiveJob(ctx context.Context, jobId string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltJobs).Get([]byte(jobId))
+		if data == nil {
+			return fmt.Errorf("job %s not found", jobId)
+		}
+		job, err := decodeJob(data)
+		if err != nil {
+			return err
+		}
+		if !jobFinished(job) {
+			return errJobNotFinished
+		}
+		if job.Status != JobCanceled {
+			job.Status = JobCompleted
+		}
+		job.Control = ""
+		job.ArchivedAt = time.Now()
+		if err := putJob(tx.Bucket(boltCompleted), job); err != nil {
+			return err
+		}
+		return tx.Bucket(boltJobs).Delete([]byte(jobId))
+	})
+	if err == nil {
+		s.changed.Notify()
+	}
+	return err
+}
+
+func (s *BoltStore) ClearControl(ctx context.Context, jobId string, control string) error {
+	cleared := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltJobs)
+		data := bucket.Get([]byte(jobId))
+		if data == nil {
+			return fmt.Errorf("job %s not found", jobId)
+		}
+		job, err := decodeJob(data)
+		if err != nil || job.Control != control {
+			return err
+		}
+		job.Control = ""
+		cleared = true
+		return putJob(bucket, job)
+	})
+	if cleared && err == nil {
+		s.changed.Notify()
+	}
+	return err
+}
+
+func (s *BoltStore) PruneArchive(ctx context.Context, cutoff time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltCompleted)
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			job, err := decodeJob(v)
+			if err == nil && job.ArchivedAt.Before(cutoff) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		if len(expired) > 0 {
+			logger.Infof("deleted %d archived jobs", len(expired))
+		}
+		return nil
+	})
+}
+
+// Nobody reads queue positions from the local store
+func (s *BoltStore) UpdateQueueProjection(ctx context.Context, proj QueueProjection) error {
+	return nil
+}
+
+func (s *BoltStore) ClearQueueProjection(ctx context.Context, gcode GcodeFile) error {
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps jobs in memory only. It backs the "memory" store
+// backend and the tests
+type MemoryStore struct {
+	mu       sync.Mutex
+	jobs     map[string]Job
+	archived map[string]Job
+	// Bumped on every write to a job, so watchers can tell what changed
+	revision  int
+	revisions map[string]int
+
+	changed Signal
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		jobs:      make(map[string]Job),
+		archived:  make(map[string]Job),
+		revisions: make(map[string]int),
+	}
+}
+
+// Copies the job so callers never share its file slice with the store
+func copyJob(job Job) Job {
+	job.GcodeFiles = append([]GcodeFile(nil), job.GcodeFiles...)
+	return job
+}
+
+// Stores a job in the jobs collection, replacing any job with its id
+func (s *MemoryStore) PutJob(job Job) {
+	job = copyJob(job)
+	job.fillFiles()
+	s.mu.Lock()
+	s.putLocked(job)
+	s.mu.Unlock()
+	s.changed.Notify()
+}
+
+func (s *MemoryStore) putLocked(job Job) {
+	s.jobs[job.JobId] = job
+	s.revision++
+	s.revisions[job.JobId] = s.revision
+}
+
+func (s *MemoryStore) RemoveJob(jobId string) {
+	s.mu.Lock()
+	delete(s.jobs, jobId)
+	delete(s.revisions, jobId)
+	s.mu.Unlock()
+	s.changed.Notify()
+}
+
+// Returns a job from the jobs collection
+func (s *MemoryStore) Job(jobId string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[jobId]
+	return copyJob(job), ok
+}
+
+// Returns a job from the archive
+func (s *MemoryStore) ArchivedJob(jobId string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.archived[jobId]
+	return copyJob(job), ok
+}
+
+func (s *MemoryStore) WatchJobs(ctx context.Context, handle func(JobChange)) error {
+	seen := make(map[string]int)
+	last := make(map[string]Job)
+	for {
+		wait := s.changed.Wait()
+
+		s.mu.Lock()
+		var changes []JobChange
+		ids := make([]string, 0, len(s.jobs))
+		for id := range s.jobs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			revision, ok := seen[id]
+			if ok && revision == s.revisions[id] {
+				continue
+			}
+			kind := JobAdded
+			if ok {
+				kind = JobModified
+			}
+			changes = append(changes, JobChange{Kind: kind, Job: copyJob(s.jobs[id])})
+			seen[id] = s.revisions[id]
+			last[id] = s.jobs[id]
+		}
+		for id := range seen {
+			if _, ok := s.jobs[id]; !ok {
+				changes = append(changes, JobChange{Kind: JobRemoved, Job: copyJob(last[id])})
+				delete(seen, id)
+				delete(last, id)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, change := range changes {
+			handle(change)
+		}
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *MemoryStore) ListJobs(ctx context.Context) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, copyJob(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].JobId < jobs[j].JobId })
+	return jobs, nil
+}
+
+func (s *MemoryStore) UpdateFileStatus(ctx context.Context, gcode GcodeFile) error {
+	s.mu.Lock()
+	job, ok := s.jobs[gcode.JobId]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("job %s not found", gcode.JobId)
+	}
+	job = copyJob(job)
+	found := gcode.FileIndex < len(job.GcodeFiles)
+	file := &GcodeFile{}
+	if found {
+		file = &job.GcodeFiles[gcode.FileIndex]
+	}
+	if err := checkFileUpdate(gcode, found, file.Filename, file.Status); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	applyFileStatus(file, gcode, time.Now())
+	s.putLocked(job)
+	s.mu.Unlock()
+	s.changed.Notify()
+	return nil
+}
+
+func (s *MemoryStore) RecordEnqueued(ctx context.Context, gcode GcodeFile) error {
+	s.mu.Lock()
+	job, ok := s.jobs[gcode.JobId]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("job %s not found", gcode.JobId)
+	}
+	job = copyJob(job)
+	found := gcode.FileIndex < len(job.GcodeFiles)
+	file := &GcodeFile{}
+	if found {
+		file = &job.GcodeFiles[gcode.FileIndex]
+	}
+	if err := checkFileUpdate(gcode, found, file.Filename, file.Status); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if !file.EnqueuedAt.IsZero() {
+		s.mu.Unlock()
+		return nil
+	}
+	file.EnqueuedAt = gcode.EnqueuedAt
+	s.putLocked(job)
+	s.mu.Unlock()
+	s.changed.Notify()
+	return nil
+}
+
+func (s *MemoryStore) ArchiveJob(ctx context.Context, jobId string) error {
+	s.mu.Lock()
+	job, ok := s.jobs[jobId]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("job %s not found", jobId)
+	}
+	if !jobFinished(job) {
+		s.mu.Unlock()
+		return errJobNotFinished
+	}
+	job = copyJob(job)
+	if job.Status != JobCanceled {
+		job.Status = JobCompleted
+	}
+	job.Control = ""
+	job.ArchivedAt = time.Now()
+	s.archived[jobId] = job
+	delete(s.jobs, jobId)
+	delete(s.revisions, jobId)
+	s.mu.Unlock()
+	s.changed.Notify()
+	return nil
+}
+
+// Nothing to close; the jobs live as long as the MemoryStore
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) ClearControl(ctx context.Context, jobId string, control string) error {
+	s.mu.Lock()
+	job, ok := s.jobs[jobId]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("job %s not found", jobId)
+	}
+	if job.Control != control {
+		s.mu.Unlock()
+		return nil
+	}
+	job.Control = ""
+	s.putLocked(job)
+	s.mu.Unlock()
+	s.changed.Notify()
+	return nil
+}
+
+func (s *MemoryStore) PruneArchive(ctx context.Context, cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, job := range s.archived {
+		if job.ArchivedAt.Before(cutoff) {
+			delete(s.archived, id)
+		}
+	}
+	return nil
+}
+
+// Queue positions aren't kept
+func (s *MemoryStore) UpdateQueueProjection(ctx context.Context, proj QueueProjection) error {
+	return nil
+}
+
+func (s *MemoryStore) ClearQueueProjection(ctx context.Context, gcode GcodeFile) error {
+	return nil
+}
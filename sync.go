@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"github.com/spf13/viper"
+)
+
+// farm-node sync: copies the local store to Firestore once the farm is back
+// online. Open jobs are written to jobs, archived ones to completed_jobs
+// and removed from jobs. Run it while farm-node is stopped, since the local
+// database can only be open in one process
+func runSync() error {
+	ctx := context.Background()
+	local, err := OpenBoltStore(viper.GetString("store.path"), viper.GetString("store.orders"))
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	client, err := FirebaseInstance(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	jobs, err := local.ListJobs(ctx)
+	if err != nil {
+		return err
+	}
+	archived, err := local.ListArchivedJobs()
+	if err != nil {
+		return err
+	}
+	if err := syncToFirestore(ctx, client, jobs, archived); err != nil {
+		return err
+	}
+	logger.Infof("synced %d jobs and %d archived jobs to Firestore", len(jobs), len(archived))
+	return nil
+}
+
+func syncToFirestore(ctx context.Context, client *firestore.Client, jobs []Job, archived []Job) error {
+	for _, job := range jobs {
+		if _, err := client.Doc("jobs/"+job.JobId).Set(ctx, job); err != nil {
+			return fmt.Errorf("job %s: %w", job.JobId, err)
+		}
+	}
+	for _, job := range archived {
+		batch := client.Batch()
+		batch.Set(client.Doc("completed_jobs/"+job.JobId), job)
+		batch.Delete(client.Doc("jobs/" + job.JobId))
+		if _, err := batch.Commit(ctx); err != nil {
+			return fmt.Errorf("archived job %s: %w", job.JobId, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tries per upload when upload.max_attempts isn't set
+const defaultUploadAttempts = 3
+
+// Progress of the upload currently running on a printer
+type UploadProgress struct {
+	Filename string
+	Sent     int64
+	Total    int64 // -1 when the source can't tell the size up front
+}
+
+// An upload failure that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// The G-code stream for one upload attempt. Reading from it hashes the
+// data and reports progress on the driver
+type uploadBody struct {
+	Filename string
+	Size     int64
+
+	sent     int64 // atomic, read back after the request completes
+	src      io.Reader
+	sum      hash.Hash
+	driver   *driverBase
+	reported int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.src.Read(p)
+	if n > 0 {
+		b.sum.Write(p[:n])
+		sent := atomic.AddInt64(&b.sent, int64(n))
+		// Report roughly every percent, or every MiB when the size is
+		// unknown, rather than on every read
+		step := int64(1 << 20)
+		if b.Size > 100*step {
+			step = b.Size / 100
+		}
+		if sent-b.reported >= step || err == io.EOF {
+			b.reported = sent
+			b.driver.setUpload(&UploadProgress{Filename: b.Filename, Sent: sent, Total: b.Size})
+		}
+	}
+	return n, err
+}
+
+// Bytes read from the source so far
+func (b *uploadBody) Sent() int64 {
+	return atomic.LoadInt64(&b.sent)
+}
+
+// Hex SHA-256 of everything read so far
+func (b *uploadBody) Checksum() string {
+	return hex.EncodeToString(b.sum.Sum(nil))
+}
+
+// Uploads a file with up to upload.max_attempts tries, reopening the source
+// each time. send does one attempt, including any check that the printer
+// stored the file intact
+func uploadWithRetry(ctx context.Context, d *driverBase, log *logrus.Entry, GF GcodeFile, send func(ctx context.Context, body *uploadBody) error) error {
+	attempts := currentSettings().MaxUploadAttempts
+	if attempts <= 0 {
+		attempts = defaultUploadAttempts
+	}
+	defer d.setUpload(nil)
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := reconnectDelay(attempt - 1)
+			log.WithFields(fileFields(GF)).Warnf("upload %s: %v, retrying in %v", GF.Filename, err, delay)
+			select {
+			case <-time.After(delay):
+			case <-d.closed:
+				return ErrDisconnected
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		err = uploadOnce(ctx, d, GF, send)
+		var permanent permanentError
+		if err == nil || errors.As(err, &permanent) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
+func uploadOnce(ctx context.Context, d *driverBase, GF GcodeFile, send func(ctx context.Context, body *uploadBody) error) error {
+	src, size, err := openGcode(ctx, GF)
+	if errors.Is(err, ErrGcodeNotFound) {
+		return permanentError{err}
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	body := &uploadBody{
+		Filename: filepath.Base(GF.Filename),
+		Size:     size,
+		src:      src,
+		sum:      sha256.New(),
+		driver:   d,
+	}
+	d.setUpload(&UploadProgress{Filename: body.Filename, Total: size})
+	return send(ctx, body)
+}
+
+// Builds a multipart/form-data POST that streams the file part straight
+// from body instead of buffering it. The fields after it are computed once
+// the file has been sent, so they can carry its checksum
+func newMultipartRequest(ctx context.Context, url string, body *uploadBody, fields func() map[string]string) (*http.Request, error) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		part, err := writer.CreateFormFile("file", body.Filename)
+		if err == nil {
+			_, err = io.Copy(part, body)
+		}
+		if err == nil && fields != nil {
+			for k, v := range fields() {
+				if err = writer.WriteField(k, v); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req, nil
+}
+
+// Turns a non-2xx upload response into an error. Client errors other than
+// timeouts, checksum mismatches and rate limits won't go away on retry
+func checkUploadResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	err := fmt.Errorf("upload: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	switch res.StatusCode {
+	case http.StatusRequestTimeout, http.StatusUnprocessableEntity, http.StatusTooManyRequests:
+		return err
+	}
+	if res.StatusCode >= 400 && res.StatusCode <= 499 {
+		return permanentError{err}
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+"use strict";
+
+// GcodeFile status codes, as in main.go
+const fileStatus = {0: "waiting", 1: "printing", 2: "printed", 3: "canceled", 4: "paused", 9: "failed"};
+// Job status codes
+const jobStatus = {0: "new", 1: "in progress", 2: "completed", 3: "canceled"};
+
+// Buttons offered for a printer in each status
+const actions = {
+  printing: ["pause", "cancel", "emergency_stop"],
+  paused: ["resume", "cancel", "emergency_stop"],
+  setup: ["cancel"],
+  resetting: ["clear"],
+  maintenance: ["acknowledge"],
+};
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === "class") node.className = v;
+    else if (k === "style") node.style.cssText = v;
+    else if (k.startsWith("on")) node.addEventListener(k.slice(2), v);
+    else node.setAttribute(k, v);
+  }
+  for (const child of children) {
+    if (child == null) continue;
+    node.append(child instanceof Node ? child : String(child));
+  }
+  return node;
+}
+
+function temp(current, target) {
+  return target > 0 ? `${current.toFixed(0)}/${target.toFixed(0)}°C` : `${current.toFixed(0)}°C`;
+}
+
+function minutes(m) {
+  if (!m) return "";
+  const h = Math.floor(m / 60);
+  return h > 0 ? `${h}h ${Math.round(m % 60)}m` : `${Math.round(m)}m`;
+}
+
+function swatch(color) {
+  return el("span", {class: "swatch", style: `background: ${color || "transparent"}`, title: color || ""});
+}
+
+async function act(printer, action) {
+  if (action === "emergency_stop" && !confirm(`Emergency stop ${printer.name}?`)) return;
+  const res = await fetch(`/printers/${encodeURIComponent(printer.id)}/${action}`, {method: "POST"});
+  if (!res.ok) {
+    const body = await res.json().catch(() => ({}));
+    alert(`${action}: ${body.error || res.statusText}`);
+  }
+}
+
+function printerCard(p) {
+  const file = p.current_file;
+  const card = el("div", {class: `card status-${p.status}` + (p.online ? "" : " offline-printer")},
+    el("h3", {}, el("span", {}, `Printer ${p.id}`), el("span", {class: "muted"}, (p.online ? p.status : "offline") + (p.draining ? ", leaving" : ""))),
+    el("p", {class: "muted"}, p.name),
+    el("p", {}, file ? file.filename : "No file"),
+  );
+  if (file || p.progress > 0) {
+    card.append(el("div", {class: "progress"}, el("div", {style: `width: ${(p.progress * 100).toFixed(1)}%`})));
+    card.append(el("p", {class: "muted"}, `${(p.progress * 100).toFixed(0)}%`));
+  }
+  if (p.upload) {
+    card.append(el("p", {class: "muted"}, `Uploading ${p.upload.filename}`));
+  }
+  card.append(el("p", {}, `Hotend ${temp(p.hotend_temp, p.hotend_target)} · Bed ${temp(p.bed_temp, p.bed_target)}`));
+  card.append(el("p", {}, swatch(p.last_color), ` ${p.last_color || "—"} ${p.last_material || ""}`));
+  if (p.maintenance_reason) {
+    card.append(el("p", {class: "file-error"}, p.maintenance_reason));
+  }
+  const buttons = el("div", {class: "actions"});
+  for (const action of actions[p.status] || []) {
+    buttons.append(el("button", {onclick: () => act(p, action)}, action.replace("_", " ")));
+  }
+  card.append(buttons);
+  return card;
+}
+
+function queueRow(q) {
+  return el("tr", {},
+    el("td", {}, q.position),
+    el("td", {}, q.filename),
+    el("td", {}, q.job_id),
+    el("td", {}, swatch(q.filament.color), ` ${q.filament.material}`),
+    el("td", {}, minutes(q.time)),
+    el("td", {}, projectedStart(q)),
+  );
+}
+
+function projectedStart(q) {
+  if (q.starts_now) {
+    return "now";
+  }
+  if (q.projected_start) {
+    return new Date(q.projected_start).toLocaleTimeString();
+  }
+  return "no printer free to take it";
+}
+
+function jobBlock(job) {
+  const files = el("ul", {});
+  for (const f of job.gcode) {
+    const status = fileStatus[f.status] || f.status;
+    files.append(el("li", {class: f.status === 9 ? "file-error" : f.status === 2 ? "file-success" : ""},
+      `${f.filename}: ${status}`, f.printer_id ? ` on printer ${f.printer_id}` : "", f.message ? ` (${f.message})` : ""));
+  }
+  return el("div", {class: "job"}, el("h3", {}, `Order ${job.id} · ${jobStatus[job.status] || job.status}`), files);
+}
+
+function render(state) {
+  document.getElementById("printers").replaceChildren(...state.printers.map(printerCard));
+  document.querySelector("#queue tbody").replaceChildren(...state.queue.map(queueRow));
+  document.getElementById("jobs").replaceChildren(...state.jobs.map(jobBlock));
+}
+
+function connect() {
+  const status = document.getElementById("connection");
+  const events = new EventSource("/events");
+  events.addEventListener("state", (e) => render(JSON.parse(e.data)));
+  events.onopen = () => { status.textContent = "live"; status.className = "online"; };
+  // EventSource reconnects on its own
+  events.onerror = () => { status.textContent = "reconnecting"; status.className = "offline"; };
+}
+
+connect();